@@ -0,0 +1,273 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/anhk/kube-relay/pkg/k8s"
+	"github.com/anhk/kube-relay/pkg/log"
+	"github.com/gin-gonic/gin"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// 管理接口中资源的状态
+type ResourceStatus struct {
+	Name            string `json:"name"` // 与--resources的格式相同
+	Kind            string `json:"kind"`
+	Namespaced      bool   `json:"namespaced"`
+	Synced          bool   `json:"synced"`
+	ResourceVersion string `json:"resourceVersion"`       // FIFO的最新resourceVersion
+	OldestVersion   string `json:"oldestResourceVersion"` // 更早的resourceVersion返回410
+	Events          int    `json:"events"`                // FIFO中保存的事件数
+	Watchers        int    `json:"watchers"`
+	Lazy            bool   `json:"lazy,omitempty"`   // 按需启动
+	Static          bool   `json:"static,omitempty"` // 来自--resources或配置文件
+}
+
+type LogLevel struct {
+	Level string `json:"level"`
+}
+
+// 资源的--resources格式名称，<resource>[.<group>]/<version>
+func resourceArg(gvr schema.GroupVersionResource) string {
+	if gvr.Group == "" {
+		return fmt.Sprintf("%v/%v", gvr.Resource, gvr.Version)
+	}
+	return fmt.Sprintf("%v.%v/%v", gvr.Resource, gvr.Group, gvr.Version)
+}
+
+func logLevelName(level int) string {
+	for name, l := range logLevels {
+		if l == level {
+			return name
+		}
+	}
+	return strconv.Itoa(level)
+}
+
+// 读取管理接口的token
+func readToken(file string) (string, error) {
+	if file == "" {
+		return "", fmt.Errorf("--admin-token-file is required")
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("admin token file %v is empty", file)
+	}
+	return token, nil
+}
+
+// 管理接口，与中继的端口分开侦听，所有请求需要携带Bearer token
+func (app *App) AdminHandler(token string) http.Handler {
+	engine := gin.New()
+	engine.Use(gin.LoggerWithWriter(os.Stdout), adminAuth(token))
+	engine.NoRoute(notFound)
+
+	engine.GET("/resources", app.adminListResources)
+	engine.POST("/resources", app.adminAddResource)
+	engine.DELETE("/resources", app.adminRemoveResource)
+	engine.POST("/resources/relist", app.adminRelistResource)
+	engine.GET("/watchers", app.adminListWatchers)
+	engine.DELETE("/watchers/:id", app.adminDisconnectWatcher)
+	engine.GET("/loglevel", adminGetLogLevel)
+	engine.PUT("/loglevel", adminSetLogLevel)
+	return engine
+}
+
+func adminAuth(token string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		got, ok := strings.CutPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			abortWithStatus(ctx, apierrors.NewUnauthorized("invalid admin token"))
+		}
+	}
+}
+
+// 按名称查找正在中继的资源，名称为--resources的格式，先按字面匹配，再通过discovery解析短名称等
+func (app *App) findHandler(name string) (*ResourceHandler, error) {
+	if name == "" {
+		return nil, apierrors.NewBadRequest("name is required")
+	}
+	want := k8s.ProcessResource(name)
+	for gvr, resHandler := range app.handlers() {
+		if gvr.Resource == want.Resource && gvr.Group == want.Group && (want.Version == "" || gvr.Version == want.Version) {
+			return resHandler, nil
+		}
+	}
+	if resolved, err := k8s.ResolveResources(app.kubeClient.Discovery(), []string{name}); err == nil && len(resolved) == 1 {
+		if resHandler, ok := app.handler(resolved[0].GVR); ok {
+			return resHandler, nil
+		}
+	}
+	return nil, apierrors.NewNotFound(schema.GroupResource{Resource: "resources"}, name)
+}
+
+func (app *App) adminListResources(ctx *gin.Context) {
+	result := []ResourceStatus{}
+	for gvr, resHandler := range app.handlers() {
+		_, static := app.staticConfig(gvr)
+		oldest, events := resHandler.fifo.Window()
+		result = append(result, ResourceStatus{
+			Name:            resourceArg(gvr),
+			Kind:            resHandler.apiRes.Kind,
+			Namespaced:      resHandler.apiRes.Namespaced,
+			Synced:          resHandler.synced != nil && resHandler.synced(),
+			ResourceVersion: resHandler.fifo.Version(),
+			OldestVersion:   oldest,
+			Events:          events,
+			Watchers:        resHandler.watcherCount(),
+			Lazy:            resHandler.lazy,
+			Static:          static,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	ctx.JSON(http.StatusOK, result)
+}
+
+// 加入资源，请求体为资源配置，名称可以是通配符；运行中加入的资源不受热加载影响
+func (app *App) adminAddResource(ctx *gin.Context) {
+	config := &ResourceConfig{}
+	if err := ctx.ShouldBindJSON(config); err != nil {
+		abortWithStatus(ctx, apierrors.NewBadRequest(err.Error()))
+		return
+	}
+	if err := config.Validate(); err != nil || strings.HasPrefix(config.Name, "-") {
+		abortWithStatus(ctx, apierrors.NewBadRequest(fmt.Sprintf("invalid resource %v: %v", config.Name, err)))
+		return
+	}
+
+	app.reloadMu.Lock()
+	defer app.reloadMu.Unlock()
+	resources, err := resolveResourceConfigs(app.kubeClient.Discovery(), []ResourceConfig{*config})
+	if err != nil {
+		abortWithStatus(ctx, apierrors.NewBadRequest(err.Error()))
+		return
+	}
+	var missing []RelayedResource
+	for _, res := range resources {
+		if _, ok := app.handler(res.GVR); !ok {
+			missing = append(missing, res)
+		}
+	}
+	if len(missing) == 0 {
+		abortWithStatus(ctx, apierrors.NewAlreadyExists(schema.GroupResource{Resource: "resources"}, config.Name))
+		return
+	}
+	started, err := app.startHandlers(missing)
+	if err != nil {
+		abortWithStatus(ctx, err)
+		return
+	}
+	added := []string{}
+	for _, resHandler := range started {
+		app.addHandler(resHandler)
+		added = append(added, resourceArg(resHandler.GVR))
+		log.Info("start relaying %v by admin request", resHandler.GVR)
+	}
+	app.resourcesChanged()
+	ctx.JSON(http.StatusCreated, added)
+}
+
+// 移除资源，正在进行的watch随之结束，CRD重建后也不再恢复
+func (app *App) adminRemoveResource(ctx *gin.Context) {
+	app.reloadMu.Lock()
+	defer app.reloadMu.Unlock()
+	resHandler, err := app.findHandler(ctx.Query("name"))
+	if err != nil {
+		abortWithStatus(ctx, err)
+		return
+	}
+	app.mu.Lock()
+	delete(app.static, resHandler.GVR)
+	app.mu.Unlock()
+	app.removeHandler(resHandler.GVR)
+	app.resourcesChanged()
+	log.Info("stop relaying %v by admin request", resHandler.GVR)
+	ctx.JSON(http.StatusOK, []string{resourceArg(resHandler.GVR)})
+}
+
+// 以新的informer重新List资源，同步后替换，原有的watch结束后客户端因410重新List
+func (app *App) adminRelistResource(ctx *gin.Context) {
+	app.reloadMu.Lock()
+	defer app.reloadMu.Unlock()
+	old, err := app.findHandler(ctx.Query("name"))
+	if err != nil {
+		abortWithStatus(ctx, err)
+		return
+	}
+	started, err := app.startHandlers([]RelayedResource{{ResolvedResource: k8s.ResolvedResource{GVR: old.GVR}, Config: old.config}})
+	if err != nil {
+		abortWithStatus(ctx, err)
+		return
+	}
+	started[0].lazy = old.lazy
+	app.addHandler(started[0])
+	old.Stop()
+	log.Info("relist %v by admin request", old.GVR)
+	ctx.JSON(http.StatusOK, []string{resourceArg(old.GVR)})
+}
+
+// 列出watch，可以按资源名称过滤
+func (app *App) adminListWatchers(ctx *gin.Context) {
+	handlers := app.handlers()
+	if name := ctx.Query("name"); name != "" {
+		resHandler, err := app.findHandler(name)
+		if err != nil {
+			abortWithStatus(ctx, err)
+			return
+		}
+		handlers = map[schema.GroupVersionResource]*ResourceHandler{resHandler.GVR: resHandler}
+	}
+	result := []*Watcher{}
+	for _, resHandler := range handlers {
+		result = append(result, resHandler.Watchers()...)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	ctx.JSON(http.StatusOK, result)
+}
+
+func (app *App) adminDisconnectWatcher(ctx *gin.Context) {
+	id, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+	if err != nil {
+		abortWithStatus(ctx, apierrors.NewBadRequest(fmt.Sprintf("invalid watcher id %v", ctx.Param("id"))))
+		return
+	}
+	for _, resHandler := range app.handlers() {
+		if resHandler.DisconnectWatcher(id) {
+			log.Info("disconnect watcher %v of %v by admin request", id, resHandler.GVR)
+			ctx.Status(http.StatusNoContent)
+			return
+		}
+	}
+	abortWithStatus(ctx, apierrors.NewNotFound(schema.GroupResource{Resource: "watchers"}, ctx.Param("id")))
+}
+
+func adminGetLogLevel(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, LogLevel{Level: logLevelName(log.GetLevel())})
+}
+
+func adminSetLogLevel(ctx *gin.Context) {
+	body := LogLevel{}
+	if err := ctx.ShouldBindJSON(&body); err != nil {
+		abortWithStatus(ctx, apierrors.NewBadRequest(err.Error()))
+		return
+	}
+	level, ok := logLevels[body.Level]
+	if !ok {
+		abortWithStatus(ctx, apierrors.NewBadRequest(fmt.Sprintf("unknown log level %v", body.Level)))
+		return
+	}
+	log.SetLevel(level)
+	log.Info("log level set to %v by admin request", body.Level)
+	ctx.JSON(http.StatusOK, body)
+}
@@ -2,13 +2,19 @@ package main
 
 import (
 	"fmt"
+	"net/http"
 	"os"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/anhk/kube-relay/pkg/k8s"
 	"github.com/anhk/kube-relay/pkg/log"
+	"github.com/anhk/kube-relay/pkg/singleflight"
 	"github.com/gin-gonic/gin"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilcache "k8s.io/apimachinery/pkg/util/cache"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
@@ -18,28 +24,55 @@ import (
 type App struct {
 	kubeClient    *kubernetes.Clientset
 	dynamicClient dynamic.Interface
+	mu            sync.RWMutex // 保护resMap及static，资源会在运行中增删
 	resMap        map[schema.GroupVersionResource]*ResourceHandler
+	static        map[schema.GroupVersionResource]*ResourceConfig // 配置中的资源，CRD重建后按原配置恢复
+	reloadMu      sync.Mutex
+	crdWatcher    *CRDWatcher
+	openapi       *OpenAPICache
+	proxy         *UpstreamProxy // 仅在--proxy时创建
+
+	lazy       bool                      // 按需启动informer
+	lazyGroup  singleflight.Group        // 合并同一资源的并发启动
+	lazyMisses *utilcache.LRUExpireCache // 上游不存在的资源
 
 	Engine *gin.Engine
 }
 
 func NewApp() *App {
-	return &App{resMap: make(map[schema.GroupVersionResource]*ResourceHandler)}
+	return &App{
+		resMap:     make(map[schema.GroupVersionResource]*ResourceHandler),
+		static:     make(map[schema.GroupVersionResource]*ResourceConfig),
+		openapi:    NewOpenAPICache(),
+		lazyMisses: utilcache.NewLRUExpireCache(MAX_LAZY_MISSES),
+	}
 }
 
 func (app *App) Run(option *Option) (err error) {
+	var adminToken string
+	if option.AdminListen != "" {
+		if adminToken, err = readToken(option.AdminTokenFile); err != nil {
+			return err
+		}
+	}
+
 	// Step. 1# 创建Kubernetes客户端
 	if app.kubeClient, err = k8s.CreateKubeClient(option.KubeConfig, option.ApiServer); err != nil {
 		return err
 	}
 
 	// Step. 2# 预处理资源
-	for _, resName := range option.ResourceNames {
-		var resHandler = NewResourceHandler(k8s.ProcessResource(resName))
+	resources, err := resolveResourceConfigs(app.kubeClient.Discovery(), option.ResourceConfigs())
+	if err != nil {
+		return err
+	}
+	for _, res := range resources {
+		var resHandler = NewResourceHandler(res.GVR, res.Config)
 		if err := resHandler.GetInfoByKubeClient(app.kubeClient); err != nil {
 			return err
 		}
 		app.resMap[resHandler.GVR] = resHandler
+		app.static[resHandler.GVR] = res.Config
 	}
 
 	// Step. 3# 建立动态客户端
@@ -47,6 +80,10 @@ func (app *App) Run(option *Option) (err error) {
 		return err
 	}
 
+	for _, resHandler := range app.resMap {
+		resHandler.LoadTableColumns(app.dynamicClient)
+	}
+
 	// Step. 4# 同步数据直到完成缓存
 	var listCached []cache.InformerSynced
 	for _, resHandler := range app.resMap {
@@ -57,50 +94,207 @@ func (app *App) Run(option *Option) (err error) {
 		log.Info("cache ok")
 	}
 
+	// 跟随CRD的创建和删除，资源变化后刷新OpenAPI文档
+	app.crdWatcher = NewCRDWatcher(app, option.CRDGroups, app.resourcesChanged)
+	if app.crdWatcher.Needed() {
+		cache.WaitForCacheSync(wait.NeverStop, app.crdWatcher.Run())
+	}
+
 	// Step. 5# 启动HTTP(s)侦听
 	gin.SetMode(gin.ReleaseMode)
 	app.Engine = gin.New()
 	app.Engine.Use(gin.LoggerWithWriter(os.Stdout))
 
-	for gvr, resHandler := range app.resMap {
-		app.SetWatchFunc(&gvr, resHandler.WatchFunc)
+	for _, resHandler := range app.resMap {
+		app.SetWatchFunc(resHandler)
 	}
-	app.SetApiListFunc()
-	return app.Engine.Run(fmt.Sprintf(":%v", option.Port))
+
+	fallback := notFound
+	if option.Proxy { // 发现文档、OpenAPI及其余请求都由上游提供
+		config, err := k8s.CreateRestConfig(option.KubeConfig, option.ApiServer)
+		if err != nil {
+			return err
+		}
+		if app.proxy, err = NewUpstreamProxy(config, app.kubeClient, option.ProxyCacheTTL); err != nil {
+			return err
+		}
+		fallback = app.proxy.ProxyFunc
+	} else {
+		// 缓存/version及OpenAPI文档，并定期刷新
+		app.openapi.Refresh(app.kubeClient, app.relayedGVRs())
+		go func() {
+			for range time.Tick(OPENAPI_REFRESH_INTERVAL) {
+				app.openapi.Refresh(app.kubeClient, app.relayedGVRs())
+			}
+		}()
+		app.SetApiListFunc()
+	}
+
+	// 运行中加入的资源没有注册路由，由ResourceFunc分发
+	app.Engine.NoRoute(app.ResourceFunc(fallback))
+	if app.lazy = option.Lazy; app.lazy { // 未注册的资源按需启动informer
+		go app.StopIdleHandlers(option.LazyIdleTimeout)
+	}
+	if option.ReloadResources != nil {
+		go app.WatchReload(option.ConfigFile, option.ReloadResources)
+	}
+	if option.ConfigObject != "" && option.ApplyConfig != nil {
+		namespace, name, err := splitConfigObject(option.ConfigObject)
+		if err != nil {
+			return err
+		}
+		NewConfigObjectWatcher(app, app.dynamicClient, namespace, name, option.ApplyConfig).Run()
+	}
+
+	var servers []*http.Server
+	for _, addr := range option.ListenAddrs() {
+		servers = append(servers, &http.Server{Addr: addr, Handler: app.Engine})
+	}
+	if option.AdminListen != "" {
+		servers = append(servers, &http.Server{Addr: option.AdminListen, Handler: app.AdminHandler(adminToken)})
+	}
+	return serve(servers)
+}
+
+// 启动全部侦听，任一侦听失败时返回
+func serve(servers []*http.Server) error {
+	errCh := make(chan error, len(servers))
+	for _, server := range servers {
+		log.Info("listening on %v", server.Addr)
+		go func(server *http.Server) { errCh <- server.ListenAndServe() }(server)
+	}
+	return <-errCh
 }
 
 func (app *App) SetApiListFunc() {
 	app.Engine.GET("/api", app.APIVersion)
 	app.Engine.GET("/apis", app.APIGroupList)
 	app.Engine.GET("/api/v1", app.APICoreResourceList)
+	app.Engine.GET("/version", app.openapi.VersionFunc)
+	app.Engine.GET("/openapi/v2", app.openapi.V2Func)
+	app.Engine.GET("/openapi/v3", app.openapi.V3IndexFunc)
+	app.Engine.GET("/openapi/v3/*gv", app.openapi.V3Func)
+	// /apis/{group}/{version}随资源的加入和移除变化，由ResourceFunc在每次请求时查找
+}
 
-	gvMap := make(map[metav1.GroupVersion]struct{})
+// 被中继的资源有变化，刷新OpenAPI文档
+func (app *App) resourcesChanged() {
+	if app.proxy == nil {
+		go app.openapi.Refresh(app.kubeClient, app.relayedGVRs())
+	}
+}
 
-	for gvr := range app.resMap {
-		gv := metav1.GroupVersion{Group: gvr.Group, Version: gvr.Version}
-		gvMap[gv] = struct{}{}
+func (app *App) relayedGVRs() []schema.GroupVersionResource {
+	gvrs := make([]schema.GroupVersionResource, 0)
+	for gvr := range app.handlers() {
+		gvrs = append(gvrs, gvr)
 	}
+	return gvrs
+}
 
-	for gv := range gvMap {
-		app.Engine.GET(fmt.Sprintf("/apis/%v/%v", gv.Group, gv.Version), app.APIResourceListByGroupVersion(gv.Group, gv.Version))
+// resMap的快照，供运行中的请求遍历
+func (app *App) handlers() map[schema.GroupVersionResource]*ResourceHandler {
+	app.mu.RLock()
+	defer app.mu.RUnlock()
+	result := make(map[schema.GroupVersionResource]*ResourceHandler, len(app.resMap))
+	for gvr, resHandler := range app.resMap {
+		result[gvr] = resHandler
 	}
+	return result
 }
 
-// 设置Watch资源的回调函数
-func (app *App) SetWatchFunc(gvr *schema.GroupVersionResource, fn gin.HandlerFunc) {
-	if gvr.Group == "" {
-		app.Engine.GET(fmt.Sprintf("/api/%v/%v", gvr.Version, gvr.Resource), fn)
-		app.Engine.GET(fmt.Sprintf("/api/%v/namespaces/:namespace/%v", gvr.Version, gvr.Resource), fn)
-		app.Engine.GET(fmt.Sprintf("/api/%v/namespaces/:namespace/%v/:name", gvr.Version, gvr.Resource), fn)
-	} else {
-		app.Engine.GET(fmt.Sprintf("/apis/%v/%v/%v", gvr.Group, gvr.Version, gvr.Resource), fn)
-		app.Engine.GET(fmt.Sprintf("/apis/%v/%v/namespaces/:namespace/%v", gvr.Group, gvr.Version, gvr.Resource), fn)
-		app.Engine.GET(fmt.Sprintf("/apis/%v/%v/namespaces/:namespace/%v/:name", gvr.Group, gvr.Version, gvr.Resource), fn)
+func (app *App) handler(gvr schema.GroupVersionResource) (*ResourceHandler, bool) {
+	app.mu.RLock()
+	defer app.mu.RUnlock()
+	resHandler, ok := app.resMap[gvr]
+	return resHandler, ok
+}
+
+// 资源在配置中时返回其配置
+func (app *App) staticConfig(gvr schema.GroupVersionResource) (*ResourceConfig, bool) {
+	app.mu.RLock()
+	defer app.mu.RUnlock()
+	config, ok := app.static[gvr]
+	return config, ok
+}
+
+func (app *App) addHandler(resHandler *ResourceHandler) {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	app.resMap[resHandler.GVR] = resHandler
+}
+
+// 移除并停止资源的handler
+func (app *App) removeHandler(gvr schema.GroupVersionResource) {
+	app.mu.Lock()
+	resHandler, ok := app.resMap[gvr]
+	delete(app.resMap, gvr)
+	app.mu.Unlock()
+	if ok {
+		resHandler.Stop()
+	}
+}
+
+// 设置Watch资源的回调函数，namespaced资源注册namespaces/:namespace下的路由，
+// cluster资源直接以名称访问，同时注册旧式的/watch/前缀路由
+func (app *App) SetWatchFunc(res *ResourceHandler) {
+	prefix := fmt.Sprintf("/apis/%v/%v", res.GVR.Group, res.GVR.Version)
+	if res.GVR.Group == "" {
+		prefix = fmt.Sprintf("/api/%v", res.GVR.Version)
+	}
+	gvr := res.GVR
+	fn := func(ctx *gin.Context) { // 每次请求时查找handler，资源被移除时返回404，重建后继续使用
+		resHandler, ok := app.handler(gvr)
+		rp, parsed := parseResourcePath(ctx.Request.URL.Path)
+		if !ok || !parsed {
+			notFound(ctx)
+			return
+		}
+		if !app.authorize(ctx, rp) {
+			return
+		}
+		resHandler.WatchFunc(ctx)
+	}
+	watchFn := func(ctx *gin.Context) {
+		ctx.Set(LEGACY_WATCH_KEY, true)
+		fn(ctx)
+	}
+
+	for _, p := range []struct {
+		prefix string
+		fn     gin.HandlerFunc
+	}{{prefix, fn}, {prefix + "/watch", watchFn}} {
+		app.Engine.GET(fmt.Sprintf("%v/%v", p.prefix, res.GVR.Resource), p.fn)
+		if res.apiRes.Namespaced {
+			app.Engine.GET(fmt.Sprintf("%v/namespaces/:namespace/%v", p.prefix, res.GVR.Resource), p.fn)
+			app.Engine.GET(fmt.Sprintf("%v/namespaces/:namespace/%v/:name", p.prefix, res.GVR.Resource), p.fn)
+		} else if res.GVR.Group == "" && res.GVR.Resource == "namespaces" {
+			// gin要求同一位置的通配参数同名，与namespaced资源共用:namespace
+			app.Engine.GET(fmt.Sprintf("%v/namespaces/:namespace", p.prefix), renameParam(p.fn, "namespace", "name"))
+		} else {
+			app.Engine.GET(fmt.Sprintf("%v/%v/:name", p.prefix, res.GVR.Resource), p.fn)
+		}
+	}
+}
+
+// 将路由参数from重命名为to
+func renameParam(fn gin.HandlerFunc, from, to string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		for i := range ctx.Params {
+			if ctx.Params[i].Key == from {
+				ctx.Params[i].Key = to
+			}
+		}
+		fn(ctx)
 	}
 }
 
 // 核心API版本
 func (app *App) APIVersion(ctx *gin.Context) {
+	if mt, ok := negotiateAggregatedDiscovery(ctx); ok {
+		app.writeAggregatedDiscovery(ctx, mt, true)
+		return
+	}
 	ctx.Writer.Write([]byte(`{"kind": "APIVersions", "versions": [ "v1" ]}`))
 }
 
@@ -109,7 +303,7 @@ func (app *App) APICoreResourceList(ctx *gin.Context) {
 	apiResourceList := &metav1.APIResourceList{}
 	apiResourceList.Kind = "APIResourceList"
 	apiResourceList.GroupVersion = "v1"
-	for gvr, resHandler := range app.resMap {
+	for gvr, resHandler := range app.handlers() {
 		if gvr.Group != "" { // 非核心API
 			continue
 		}
@@ -120,30 +314,62 @@ func (app *App) APICoreResourceList(ctx *gin.Context) {
 
 // 返回非核心API列表
 func (app *App) APIGroupList(ctx *gin.Context) {
+	if mt, ok := negotiateAggregatedDiscovery(ctx); ok {
+		app.writeAggregatedDiscovery(ctx, mt, false)
+		return
+	}
 	apiGroupList := &metav1.APIGroupList{}
 	apiGroupList.Kind = "APIGroupList"
 	apiGroupList.APIVersion = "v1"
-	for gvr, resHandler := range app.resMap {
+	apiGroupList.Groups = app.apiGroups()
+	ctx.JSON(200, apiGroupList)
+}
+
+// 按group合并被中继的资源，同一group的多个版本按kube-aware规则降序排列，首个为preferredVersion
+func (app *App) apiGroups() []metav1.APIGroup {
+	versions := make(map[string][]string) // group -> versions
+	seen := make(map[schema.GroupVersion]struct{})
+	for gvr := range app.handlers() {
 		if gvr.Group == "" { // 核心API
 			continue
 		}
-		apiGroupList.Groups = append(apiGroupList.Groups, resHandler.apiGr)
+		if _, ok := seen[gvr.GroupVersion()]; ok {
+			continue
+		}
+		seen[gvr.GroupVersion()] = struct{}{}
+		versions[gvr.Group] = append(versions[gvr.Group], gvr.Version)
 	}
-	ctx.JSON(200, apiGroupList)
+
+	groups := []metav1.APIGroup{}
+	for name, vers := range versions {
+		sortVersions(vers)
+		group := metav1.APIGroup{Name: name}
+		for _, ver := range vers {
+			group.Versions = append(group.Versions, metav1.GroupVersionForDiscovery{GroupVersion: name + "/" + ver, Version: ver})
+		}
+		group.PreferredVersion = group.Versions[0]
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+	return groups
 }
 
 func (app *App) APIResourceListByGroupVersion(gr, ver string) func(*gin.Context) {
 	return func(ctx *gin.Context) {
 		apiResourceList := &metav1.APIResourceList{}
 		apiResourceList.Kind = "APIResourceList"
-		apiResourceList.APIVersion = ver
+		apiResourceList.APIVersion = "v1"
 		apiResourceList.GroupVersion = fmt.Sprintf("%v/%v", gr, ver)
 
-		for gvr, resHandler := range app.resMap {
+		for gvr, resHandler := range app.handlers() {
 			if gvr.Group == gr && gvr.Version == ver {
 				apiResourceList.APIResources = append(apiResourceList.APIResources, resHandler.apiRes)
 			}
 		}
+		if len(apiResourceList.APIResources) == 0 { // 资源已被移除
+			notFound(ctx)
+			return
+		}
 		ctx.JSON(200, apiResourceList)
 	}
 }
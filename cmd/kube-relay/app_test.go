@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// /apis/{group}/{version}随资源变化，CRD删除后返回404
+func TestGroupVersionDiscovery(t *testing.T) {
+	app := NewApp()
+	gin.SetMode(gin.TestMode)
+	app.Engine = gin.New()
+	app.Engine.NoRoute(app.ResourceFunc(notFound))
+	relay := httptest.NewServer(app.Engine)
+	defer relay.Close()
+
+	gvr := schema.GroupVersionResource{Group: "example.com", Version: "v1", Resource: "widgets"}
+	res := NewResourceHandler(gvr, nil)
+	res.apiRes = metav1.APIResource{Name: "widgets", Namespaced: true, Kind: "Widget"}
+	get := func() int {
+		resp, err := http.Get(relay.URL + "/apis/example.com/v1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := get(); code != http.StatusNotFound {
+		t.Errorf("before the resource is added: %v, want 404", code)
+	}
+	app.mu.Lock()
+	app.resMap[gvr] = res
+	app.mu.Unlock()
+	if code := get(); code != http.StatusOK {
+		t.Errorf("after the resource is added: %v, want 200", code)
+	}
+	app.mu.Lock()
+	delete(app.resMap, gvr)
+	app.mu.Unlock()
+	if code := get(); code != http.StatusNotFound {
+		t.Errorf("after the resource is removed: %v, want 404", code)
+	}
+}
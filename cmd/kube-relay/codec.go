@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer/protobuf"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+const (
+	MIME_JSON     = "application/json"
+	MIME_PROTOBUF = "application/vnd.kubernetes.protobuf"
+)
+
+// 响应的编码方式，由Accept头协商得到
+type ResponseCodec interface {
+	// 输出对象或列表
+	WriteObject(ctx *gin.Context, code int, obj runtime.Object)
+	// 输出Watch事件，调用者负责Flush
+	WriteEvent(ctx *gin.Context, event *metav1.WatchEvent)
+	// Watch流的content-type
+	StreamContentType() string
+}
+
+// 协商得到的媒体类型
+type MediaType struct {
+	Type   string
+	Params map[string]string
+}
+
+// 解析Accept头，按顺序返回媒体类型
+func parseAccept(accept string) []MediaType {
+	var result []MediaType
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		result = append(result, MediaType{Type: mediaType, Params: params})
+	}
+	return result
+}
+
+// 根据Accept头及资源类型选择编码方式，protobuf仅支持内置类型，CRD回退到JSON；
+// 带有as参数的媒体类型中Table只支持JSON，PartialObjectMetadata支持JSON及protobuf
+func (res *ResourceHandler) negotiateCodec(ctx *gin.Context) ResponseCodec {
+	for _, mt := range parseAccept(ctx.GetHeader("Accept")) {
+		if as := mt.Params["as"]; as != "" {
+			if mt.Params["g"] != "meta.k8s.io" {
+				continue
+			}
+			switch {
+			case as == "Table" && mt.Type == MIME_JSON && (mt.Params["v"] == "v1" || mt.Params["v"] == "v1beta1"):
+				return newTableCodec(ctx, res, mt.Params["v"])
+			case (as == "PartialObjectMetadata" || as == "PartialObjectMetadataList") && mt.Params["v"] == "v1":
+				if mt.Type == MIME_JSON {
+					return &metadataCodec{&jsonCodec{}}
+				} else if mt.Type == MIME_PROTOBUF {
+					return &metadataCodec{&protobufCodec{gvk: res.GVK()}}
+				}
+			}
+			continue
+		}
+
+		switch mt.Type {
+		case MIME_PROTOBUF:
+			if scheme.Scheme.Recognizes(res.GVK()) {
+				return &protobufCodec{gvk: res.GVK()}
+			}
+		case MIME_JSON, "*/*", "application/*":
+			return &jsonCodec{}
+		}
+	}
+	return &jsonCodec{}
+}
+
+type jsonCodec struct{}
+
+func (c *jsonCodec) WriteObject(ctx *gin.Context, code int, obj runtime.Object) {
+	ctx.JSON(code, obj)
+}
+
+func (c *jsonCodec) WriteEvent(ctx *gin.Context, event *metav1.WatchEvent) {
+	data, _ := json.Marshal(event)
+	ctx.Writer.Write(data)
+}
+
+func (c *jsonCodec) StreamContentType() string {
+	return MIME_JSON
+}
+
+var (
+	protobufSerializer    = protobuf.NewSerializer(scheme.Scheme, scheme.Scheme)
+	protobufRawSerializer = protobuf.NewRawSerializer(scheme.Scheme, scheme.Scheme)
+)
+
+type protobufCodec struct {
+	gvk schema.GroupVersionKind
+}
+
+func (c *protobufCodec) WriteObject(ctx *gin.Context, code int, obj runtime.Object) {
+	data, err := c.encode(obj)
+	if err != nil {
+		abortWithStatus(ctx, err)
+		return
+	}
+	ctx.Data(code, MIME_PROTOBUF, data)
+}
+
+// Watch事件以长度前缀分帧，事件中的对象使用带前缀的protobuf编码
+func (c *protobufCodec) WriteEvent(ctx *gin.Context, event *metav1.WatchEvent) {
+	data, err := c.encode(event.Object.Object)
+	if err != nil {
+		data, _ = c.encode(errorStatus(err))
+		event = &metav1.WatchEvent{Type: "ERROR"}
+	}
+
+	buf := bytes.Buffer{}
+	if err := protobufRawSerializer.Encode(&metav1.WatchEvent{Type: event.Type, Object: runtime.RawExtension{Raw: data}}, &buf); err != nil {
+		return
+	}
+	protobuf.LengthDelimitedFramer.NewFrameWriter(ctx.Writer).Write(buf.Bytes())
+}
+
+func (c *protobufCodec) StreamContentType() string {
+	return MIME_PROTOBUF + ";stream=watch"
+}
+
+func (c *protobufCodec) encode(obj runtime.Object) ([]byte, error) {
+	typed, err := c.toTyped(obj)
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.Buffer{}
+	if err := protobufSerializer.Encode(typed, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// 将Unstructured对象或ListWrapper转换为scheme中注册的内置类型
+func (c *protobufCodec) toTyped(obj runtime.Object) (runtime.Object, error) {
+	switch t := obj.(type) {
+	case *unstructured.Unstructured:
+		typed, err := scheme.Scheme.New(t.GroupVersionKind())
+		if err != nil {
+			return nil, err
+		}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(t.Object, typed); err != nil {
+			return nil, err
+		}
+		typed.GetObjectKind().SetGroupVersionKind(t.GroupVersionKind())
+		return typed, nil
+	case *ListWrapper:
+		listGVK := c.gvk.GroupVersion().WithKind(c.gvk.Kind + "List")
+		list, err := scheme.Scheme.New(listGVK)
+		if err != nil {
+			return nil, err
+		}
+		items := make([]runtime.Object, 0, len(t.Items))
+		for _, item := range t.Items {
+			typed, err := c.toTyped(item)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, typed)
+		}
+		if err := meta.SetList(list, items); err != nil {
+			return nil, err
+		}
+		listMeta, err := meta.ListAccessor(list)
+		if err != nil {
+			return nil, err
+		}
+		listMeta.SetResourceVersion(t.Metadata.ResourceVersion)
+		listMeta.SetContinue(t.Metadata.Continue)
+		listMeta.SetRemainingItemCount(t.Metadata.RemainingItemCount)
+		list.GetObjectKind().SetGroupVersionKind(listGVK)
+		return list, nil
+	}
+	return obj, nil
+}
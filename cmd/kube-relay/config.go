@@ -0,0 +1,331 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/anhk/kube-relay/pkg/k8s"
+	"github.com/anhk/kube-relay/pkg/log"
+	"github.com/spf13/pflag"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	CONFIG_API_VERSION = "kube-relay.anhk.io/v1alpha1"
+	CONFIG_KIND        = "RelayConfig"
+)
+
+// --config指定的配置文件，global对应命令行参数，命令行中显式指定的参数优先
+type RelayConfig struct {
+	metav1.TypeMeta `json:",inline"`
+	RelayConfigSpec `json:",inline"`
+}
+
+// 配置的内容，也是RelayConfig对象的spec
+type RelayConfigSpec struct {
+	Global    GlobalConfig     `json:"global"`
+	Resources []ResourceConfig `json:"resources"`
+}
+
+type GlobalConfig struct {
+	Listen   []string       `json:"listen,omitempty"` // 侦听地址，如:8443、127.0.0.1:8080
+	Upstream UpstreamConfig `json:"upstream,omitempty"`
+	LogLevel string         `json:"logLevel,omitempty"` // none、error、warn、info、debug
+
+	Proxy           bool             `json:"proxy,omitempty"`
+	ProxyCacheTTL   *metav1.Duration `json:"proxyCacheTTL,omitempty"`
+	Lazy            bool             `json:"lazy,omitempty"`
+	LazyIdleTimeout *metav1.Duration `json:"lazyIdleTimeout,omitempty"`
+	CRDGroups       []string         `json:"crdGroups,omitempty"`
+
+	Admin AdminConfig `json:"admin,omitempty"`
+}
+
+type AdminConfig struct {
+	Listen    string `json:"listen,omitempty"`
+	TokenFile string `json:"tokenFile,omitempty"`
+}
+
+type UpstreamConfig struct {
+	KubeConfig string  `json:"kubeconfig,omitempty"`
+	ApiServer  string  `json:"apiServer,omitempty"`
+	QPS        float32 `json:"qps,omitempty"`
+	Burst      int     `json:"burst,omitempty"`
+}
+
+// 单个资源的配置，name为通配符时对匹配到的每个资源生效
+type ResourceConfig struct {
+	Name         string           `json:"name"`               // 格式与--resources相同，以-开头表示排除
+	FIFOSize     int              `json:"fifoSize,omitempty"` // 保留的watch事件数，默认MAX_RESOURCE_FIFO_LEN
+	ResyncPeriod *metav1.Duration `json:"resyncPeriod,omitempty"`
+
+	// 只缓存这些namespace中的对象，以及上游的label、field selector，支持环境变量，如spec.nodeName=$NODE_NAME
+	Namespaces    []string        `json:"namespaces,omitempty"`
+	LabelSelector string          `json:"labelSelector,omitempty"`
+	FieldSelector string          `json:"fieldSelector,omitempty"`
+	Transforms    TransformConfig `json:"transforms,omitempty"`
+}
+
+// 对象写入缓存前的修改
+type TransformConfig struct {
+	DropFields        []string `json:"dropFields,omitempty"`       // JSON路径，如.status.conditions
+	StripAnnotations  []string `json:"stripAnnotations,omitempty"` // annotation前缀
+	TrimManagedFields bool     `json:"trimManagedFields,omitempty"`
+}
+
+func (t *TransformConfig) Empty() bool {
+	return len(t.DropFields) == 0 && len(t.StripAnnotations) == 0 && !t.TrimManagedFields
+}
+
+var logLevels = map[string]int{
+	"none": log.LEVEL_NONE, "error": log.LEVEL_ERROR, "warn": log.LEVEL_WARN, "info": log.LEVEL_INFO, "debug": log.LEVEL_DEBUG,
+}
+
+// 读取并检查配置文件，未知字段视为错误
+func LoadConfig(file string) (*RelayConfig, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	conf := &RelayConfig{}
+	if err := yaml.UnmarshalStrict(data, conf); err != nil {
+		return nil, fmt.Errorf("parse %v: %v", file, err)
+	}
+	if err := conf.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid %v: %v", file, err)
+	}
+	return conf, nil
+}
+
+// 不依赖上游的检查
+func (conf *RelayConfig) Validate() error {
+	if conf.APIVersion != CONFIG_API_VERSION || conf.Kind != CONFIG_KIND {
+		return fmt.Errorf("unsupported apiVersion/kind %v/%v, expected %v/%v", conf.APIVersion, conf.Kind, CONFIG_API_VERSION, CONFIG_KIND)
+	}
+	return conf.RelayConfigSpec.Validate()
+}
+
+func (conf *RelayConfigSpec) Validate() error {
+	for _, addr := range conf.Global.Listen {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("global.listen: %v", err)
+		}
+	}
+	if addr := conf.Global.Admin.Listen; addr != "" {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("global.admin.listen: %v", err)
+		}
+	}
+	if _, ok := logLevels[conf.Global.LogLevel]; conf.Global.LogLevel != "" && !ok {
+		return fmt.Errorf("global.logLevel: unknown level %v", conf.Global.LogLevel)
+	}
+	if conf.Global.Upstream.QPS < 0 || conf.Global.Upstream.Burst < 0 {
+		return fmt.Errorf("global.upstream: qps and burst must not be negative")
+	}
+	if timeout := conf.Global.LazyIdleTimeout; timeout != nil && timeout.Duration <= 0 {
+		return fmt.Errorf("global.lazyIdleTimeout must be positive")
+	}
+	for i, res := range conf.Resources {
+		if err := res.Validate(); err != nil {
+			return fmt.Errorf("resources[%d]: %v", i, err)
+		}
+	}
+	return nil
+}
+
+func (res *ResourceConfig) Validate() error {
+	if strings.TrimPrefix(res.Name, "-") == "" {
+		return fmt.Errorf("name is required")
+	}
+	if res.FIFOSize < 0 {
+		return fmt.Errorf("fifoSize must not be negative")
+	}
+	if res.ResyncPeriod != nil && res.ResyncPeriod.Duration < 0 {
+		return fmt.Errorf("resyncPeriod must not be negative")
+	}
+	for _, namespace := range res.Namespaces {
+		expanded, err := expandEnv(namespace)
+		if err != nil {
+			return fmt.Errorf("namespaces: %v", err)
+		}
+		if errs := validation.IsDNS1123Label(expanded); len(errs) > 0 {
+			return fmt.Errorf("namespaces: invalid namespace %q: %v", namespace, strings.Join(errs, ", "))
+		}
+	}
+	labelSelector, err := expandEnv(res.LabelSelector)
+	if err == nil {
+		_, err = labels.Parse(labelSelector)
+	}
+	if err != nil {
+		return fmt.Errorf("labelSelector: %v", err)
+	}
+	fieldSelector, err := expandEnv(res.FieldSelector)
+	if err == nil {
+		_, err = fields.ParseSelector(fieldSelector)
+	}
+	if err != nil {
+		return fmt.Errorf("fieldSelector: %v", err)
+	}
+	if err := res.Transforms.Validate(); err != nil {
+		return fmt.Errorf("transforms.%v", err)
+	}
+	return nil
+}
+
+// 将配置写入option，命令行中显式指定的参数不覆盖
+func (conf *RelayConfig) ApplyTo(option *Option, flags *pflag.FlagSet) {
+	set := func(name string, apply func()) {
+		if !flags.Changed(name) {
+			apply()
+		}
+	}
+	global := &conf.Global
+	if len(global.Listen) > 0 {
+		set("port", func() { option.Listen = global.Listen })
+	}
+	if global.Upstream.KubeConfig != "" {
+		set("kubeconfig", func() { option.KubeConfig = global.Upstream.KubeConfig })
+	}
+	if global.Upstream.ApiServer != "" {
+		set("apiserver", func() { option.ApiServer = global.Upstream.ApiServer })
+	}
+	if global.Upstream.QPS > 0 {
+		set("qps", func() { k8s.QPS = global.Upstream.QPS })
+	}
+	if global.Upstream.Burst > 0 {
+		set("burst", func() { k8s.Burst = global.Upstream.Burst })
+	}
+	if global.LogLevel != "" {
+		set("verbose", func() { log.SetLevel(logLevels[global.LogLevel]) })
+	}
+	if global.Proxy {
+		set("proxy", func() { option.Proxy = true })
+	}
+	if global.ProxyCacheTTL != nil {
+		set("proxy-cache-ttl", func() { option.ProxyCacheTTL = global.ProxyCacheTTL.Duration })
+	}
+	if global.Lazy {
+		set("lazy", func() { option.Lazy = true })
+	}
+	if global.LazyIdleTimeout != nil {
+		set("lazy-idle-timeout", func() { option.LazyIdleTimeout = global.LazyIdleTimeout.Duration })
+	}
+	if len(global.CRDGroups) > 0 {
+		set("crd-groups", func() { option.CRDGroups = global.CRDGroups })
+	}
+	if global.Admin.Listen != "" {
+		set("admin-listen", func() { option.AdminListen = global.Admin.Listen })
+	}
+	if global.Admin.TokenFile != "" {
+		set("admin-token-file", func() { option.AdminTokenFile = global.Admin.TokenFile })
+	}
+	if len(conf.Resources) > 0 {
+		set("resources", func() { option.Resources = conf.Resources })
+	}
+}
+
+// 被中继的资源及其配置
+type RelayedResource struct {
+	k8s.ResolvedResource
+	Config *ResourceConfig
+}
+
+// 通过discovery将资源配置解析为GVR，一个资源匹配多条配置时使用第一条
+func resolveResourceConfigs(client discovery.DiscoveryInterface, configs []ResourceConfig) ([]RelayedResource, error) {
+	names := make([]string, 0, len(configs))
+	for _, conf := range configs {
+		names = append(names, conf.Name)
+	}
+	resolved, err := k8s.ResolveResources(client, names)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]RelayedResource, 0, len(resolved))
+	for _, res := range resolved {
+		result = append(result, RelayedResource{ResolvedResource: res, Config: &configs[res.Arg]})
+	}
+	return result, nil
+}
+
+func (res *ResourceConfig) resyncPeriod() time.Duration {
+	if res == nil || res.ResyncPeriod == nil || res.ResyncPeriod.Duration == 0 {
+		return RESYNC_PERIOD
+	}
+	return res.ResyncPeriod.Duration
+}
+
+// 上游的namespace，未配置时为全部namespace
+func (res *ResourceConfig) upstreamNamespaces() []string {
+	if res == nil || len(res.Namespaces) == 0 {
+		return []string{metav1.NamespaceAll}
+	}
+	result := sets.NewString()
+	for _, namespace := range res.Namespaces {
+		expanded, _ := expandEnv(namespace) // 已经校验过
+		result.Insert(expanded)
+	}
+	return result.List()
+}
+
+// 展开$VAR或${VAR}，变量未设置或为空时报错，避免spec.nodeName=$NODE静默变为spec.nodeName=
+func expandEnv(s string) (string, error) {
+	var missing []string
+	expanded := os.Expand(s, func(name string) string {
+		val := os.Getenv(name)
+		if val == "" {
+			missing = append(missing, name)
+		}
+		return val
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variable %v is not set", strings.Join(missing, ", "))
+	}
+	return expanded, nil
+}
+
+// 设置上游的label及field selector
+func (res *ResourceConfig) tweakListOptions() dynamicinformer.TweakListOptionsFunc {
+	if res == nil || (res.LabelSelector == "" && res.FieldSelector == "") {
+		return nil
+	}
+	labelSelector, _ := expandEnv(res.LabelSelector) // 已经校验过
+	fieldSelector, _ := expandEnv(res.FieldSelector)
+	return func(opts *metav1.ListOptions) {
+		opts.LabelSelector = labelSelector
+		opts.FieldSelector = fieldSelector
+	}
+}
+
+func (res *ResourceConfig) fifoSize() int {
+	if res == nil || res.FIFOSize == 0 {
+		return MAX_RESOURCE_FIFO_LEN
+	}
+	return res.FIFOSize
+}
+
+// 两份配置对资源的效果是否相同，不比较名称
+func sameSettings(a, b *ResourceConfig) bool {
+	return reflect.DeepEqual(a.settings(), b.settings())
+}
+
+func (res *ResourceConfig) settings() ResourceConfig {
+	var s ResourceConfig
+	if res != nil {
+		s = *res
+	}
+	s.Name = ""
+	s.FIFOSize = res.fifoSize()
+	s.ResyncPeriod = &metav1.Duration{Duration: res.resyncPeriod()}
+	return s
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anhk/kube-relay/pkg/log"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// 跟随CRD的创建和删除增减被中继的资源：匹配--crd-groups的CRD自动中继，
+// 被删除的CRD停止informer并结束其watch，之后的请求返回404
+type CRDWatcher struct {
+	app      *App
+	groups   []string // group的通配模式，如*.example.com
+	lister   cache.GenericLister
+	queue    workqueue.RateLimitingInterface // key: CRD的名称，<plural>.<group>
+	onChange func()
+
+	once   sync.Once
+	synced cache.InformerSynced
+}
+
+func NewCRDWatcher(app *App, groups []string, onChange func()) *CRDWatcher {
+	w := &CRDWatcher{
+		app:      app,
+		groups:   groups,
+		queue:    workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		onChange: onChange,
+	}
+	return w
+}
+
+// 是否需要跟随CRD：配置了group模式，或配置的资源中有自定义资源
+func (w *CRDWatcher) Needed() bool {
+	if len(w.groups) > 0 {
+		return true
+	}
+	for gvr, resHandler := range w.app.handlers() {
+		if _, ok := w.app.staticConfig(gvr); ok && !scheme.Scheme.Recognizes(resHandler.GVK()) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *CRDWatcher) matchGroup(group string) bool {
+	for _, pattern := range w.groups {
+		if ok, _ := path.Match(pattern, group); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// 启动informer，多次调用只启动一次
+func (w *CRDWatcher) Run() cache.InformerSynced {
+	w.once.Do(w.run)
+	return w.synced
+}
+
+func (w *CRDWatcher) run() {
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(w.app.dynamicClient, RESYNC_PERIOD, "", nil)
+	informer := factory.ForResource(crdGVR)
+	enqueue := func(obj any) {
+		if key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj); err == nil {
+			w.queue.Add(key)
+		}
+	}
+	informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    enqueue,
+		UpdateFunc: func(_, newObj any) { enqueue(newObj) },
+		DeleteFunc: enqueue,
+	})
+	w.lister = informer.Lister()
+	go informer.Informer().Run(wait.NeverStop)
+	go wait.Until(w.worker, time.Second, wait.NeverStop)
+	w.synced = informer.Informer().HasSynced
+}
+
+func (w *CRDWatcher) worker() {
+	for {
+		key, quit := w.queue.Get()
+		if quit {
+			return
+		}
+		if err := w.reconcile(key.(string)); err != nil {
+			log.Warn("reconcile CustomResourceDefinition %v failed: %v", key, err)
+			w.queue.AddRateLimited(key)
+		} else {
+			w.queue.Forget(key)
+		}
+		w.queue.Done(key)
+	}
+}
+
+// 使被中继的资源与CRD当前提供的版本一致
+func (w *CRDWatcher) reconcile(name string) error {
+	plural, group, ok := strings.Cut(name, ".")
+	if !ok {
+		return nil
+	}
+
+	served := make(map[schema.GroupVersionResource]bool)  // CRD当前提供的版本
+	desired := make(map[schema.GroupVersionResource]bool) // 需要自动中继的版本
+	obj, err := w.lister.Get(name)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	if err == nil && crdEstablished(obj.(*unstructured.Unstructured)) {
+		versions, _, _ := unstructured.NestedSlice(obj.(*unstructured.Unstructured).Object, "spec", "versions")
+		for _, v := range versions {
+			version, _ := v.(map[string]any)
+			if ok, _ := version["served"].(bool); !ok {
+				continue
+			}
+			gvr := schema.GroupVersionResource{Group: group, Version: fmt.Sprint(version["name"]), Resource: plural}
+			served[gvr] = true
+			if _, ok := w.app.staticConfig(gvr); ok || w.matchGroup(group) {
+				desired[gvr] = true
+			}
+		}
+	}
+
+	changed := false
+	for gvr := range w.app.handlers() {
+		if gvr.Group == group && gvr.Resource == plural && !served[gvr] {
+			w.app.removeHandler(gvr)
+			log.Info("CustomResourceDefinition %v removed, stop relaying %v", name, gvr)
+			changed = true
+		}
+	}
+	for gvr := range desired {
+		if _, ok := w.app.handler(gvr); ok {
+			continue
+		}
+		config, _ := w.app.staticConfig(gvr)
+		resHandler := NewResourceHandler(gvr, config)
+		if err := resHandler.GetInfoByKubeClient(w.app.kubeClient); err != nil { // discovery可能稍晚于CRD就绪
+			return err
+		}
+		resHandler.LoadTableColumns(w.app.dynamicClient)
+		resHandler.RunWithDynamicClient(w.app.dynamicClient)
+		w.app.addHandler(resHandler)
+		log.Info("CustomResourceDefinition %v established, start relaying %v", name, gvr)
+		changed = true
+	}
+	if changed && w.onChange != nil {
+		w.onChange()
+	}
+	return nil
+}
+
+// CRD的Established条件为True时才能提供服务
+func crdEstablished(crd *unstructured.Unstructured) bool {
+	conditions, _, _ := unstructured.NestedSlice(crd.Object, "status", "conditions")
+	for _, c := range conditions {
+		cond, _ := c.(map[string]any)
+		if cond["type"] == "Established" {
+			return cond["status"] == "True"
+		}
+	}
+	return false
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/duration"
+)
+
+var ctlServer string
+
+// 调用管理接口，body及out可以为nil
+func adminRequest(method, path string, query url.Values, body, out any) error {
+	token, err := readToken(option.AdminTokenFile)
+	if err != nil {
+		return err
+	}
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	target := strings.TrimSuffix(ctlServer, "/") + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, target, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", MIME_JSON)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		status := metav1.Status{}
+		if json.NewDecoder(resp.Body).Decode(&status) == nil && status.Message != "" {
+			return fmt.Errorf("%v", status.Message)
+		}
+		return fmt.Errorf("%v %v: %v", method, path, resp.Status)
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func nameQuery(name string) url.Values {
+	return url.Values{"name": []string{name}}
+}
+
+// 每个名称一行
+func printNames(cmd *cobra.Command, verb string, names []string) {
+	for _, name := range names {
+		fmt.Fprintf(cmd.OutOrStdout(), "%v %v\n", name, verb)
+	}
+}
+
+var ctlCmd = &cobra.Command{
+	Use:          "ctl",
+	Short:        "inspect and steer a running relay through its admin API",
+	SilenceUsage: true,
+	Example: "  kube-relay ctl resources --server http://127.0.0.1:8444 --admin-token-file token\n" +
+		"  kube-relay ctl add 'ingresses.networking.k8s.io' --fifo-size 4096\n" +
+		"  kube-relay ctl disconnect 42",
+}
+
+var ctlResourcesCmd = &cobra.Command{
+	Use:   "resources",
+	Short: "list relayed resources with their sync state and FIFO window",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var result []ResourceStatus
+		if err := adminRequest(http.MethodGet, "/resources", nil, nil, &result); err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tKIND\tSYNCED\tRESOURCEVERSION\tOLDEST\tEVENTS\tWATCHERS\tSOURCE")
+		for _, res := range result {
+			source := "admin"
+			if res.Static {
+				source = "config"
+			} else if res.Lazy {
+				source = "lazy"
+			}
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", res.Name, res.Kind, res.Synced, res.ResourceVersion, res.OldestVersion, res.Events, res.Watchers, source)
+		}
+		return w.Flush()
+	},
+}
+
+var (
+	ctlFIFOSize     int
+	ctlResyncPeriod time.Duration
+)
+
+var ctlAddCmd = &cobra.Command{
+	Use:   "add NAME",
+	Short: "start relaying the resources matching NAME, in the same syntax as --resources",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config := &ResourceConfig{Name: args[0], FIFOSize: ctlFIFOSize}
+		if ctlResyncPeriod > 0 {
+			config.ResyncPeriod = &metav1.Duration{Duration: ctlResyncPeriod}
+		}
+		var added []string
+		if err := adminRequest(http.MethodPost, "/resources", nil, config, &added); err != nil {
+			return err
+		}
+		printNames(cmd, "added", added)
+		return nil
+	},
+}
+
+var ctlRemoveCmd = &cobra.Command{
+	Use:   "remove NAME",
+	Short: "stop relaying a resource and close its watches",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var removed []string
+		if err := adminRequest(http.MethodDelete, "/resources", nameQuery(args[0]), nil, &removed); err != nil {
+			return err
+		}
+		printNames(cmd, "removed", removed)
+		return nil
+	},
+}
+
+var ctlRelistCmd = &cobra.Command{
+	Use:   "relist NAME",
+	Short: "list a resource from the apiserver again with a new informer",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var relisted []string
+		if err := adminRequest(http.MethodPost, "/resources/relist", nameQuery(args[0]), nil, &relisted); err != nil {
+			return err
+		}
+		printNames(cmd, "relisted", relisted)
+		return nil
+	},
+}
+
+var ctlWatchersCmd = &cobra.Command{
+	Use:   "watchers [NAME]",
+	Short: "list open watches, optionally of one resource",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var query url.Values
+		if len(args) > 0 {
+			query = nameQuery(args[0])
+		}
+		var result []*Watcher
+		if err := adminRequest(http.MethodGet, "/watchers", query, nil, &result); err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tRESOURCE\tNAMESPACE\tNAME\tREMOTE\tUSER-AGENT\tAGE")
+		for _, watcher := range result {
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", watcher.ID, watcher.Resource, watcher.Namespace, watcher.Name,
+				watcher.Remote, watcher.UserAgent, duration.HumanDuration(time.Since(watcher.Since)))
+		}
+		return w.Flush()
+	},
+}
+
+var ctlDisconnectCmd = &cobra.Command{
+	Use:   "disconnect ID",
+	Short: "close a watch, the client will reconnect",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := adminRequest(http.MethodDelete, "/watchers/"+url.PathEscape(args[0]), nil, nil, nil); err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "watcher %v disconnected\n", args[0])
+		return nil
+	},
+}
+
+var ctlLogLevelCmd = &cobra.Command{
+	Use:   "log-level [none|error|warn|info|debug]",
+	Short: "show or change the log level",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var level LogLevel
+		var err error
+		if len(args) > 0 {
+			err = adminRequest(http.MethodPut, "/loglevel", nil, &LogLevel{Level: args[0]}, &level)
+		} else {
+			err = adminRequest(http.MethodGet, "/loglevel", nil, nil, &level)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(cmd.OutOrStdout(), level.Level)
+		return nil
+	},
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	apidiscoveryv2beta1 "k8s.io/api/apidiscovery/v2beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/version"
+)
+
+const APIDISCOVERY_GROUP = "apidiscovery.k8s.io"
+
+// 判断是否请求聚合发现文档(apidiscovery.k8s.io/v2及v2beta1)，两个版本的结构完全相同
+func negotiateAggregatedDiscovery(ctx *gin.Context) (MediaType, bool) {
+	for _, mt := range parseAccept(ctx.GetHeader("Accept")) {
+		if mt.Params["g"] != APIDISCOVERY_GROUP || mt.Params["as"] != "APIGroupDiscoveryList" {
+			continue
+		}
+		if mt.Params["v"] != "v2" && mt.Params["v"] != "v2beta1" {
+			continue
+		}
+		if mt.Type == MIME_JSON || mt.Type == MIME_PROTOBUF {
+			return mt, true
+		}
+	}
+	return MediaType{}, false
+}
+
+// 输出聚合发现文档，core为true时只包含核心API(/api)，否则只包含非核心API(/apis)
+func (app *App) writeAggregatedDiscovery(ctx *gin.Context, mt MediaType, core bool) {
+	list := app.aggregatedDiscovery(core)
+	list.APIVersion = fmt.Sprintf("%v/%v", APIDISCOVERY_GROUP, mt.Params["v"])
+	list.Kind = "APIGroupDiscoveryList"
+
+	// client-go根据响应的content-type判断是否为聚合发现文档
+	contentType := fmt.Sprintf("%v;g=%v;v=%v;as=APIGroupDiscoveryList", mt.Type, APIDISCOVERY_GROUP, mt.Params["v"])
+	if mt.Type == MIME_PROTOBUF {
+		buf := bytes.Buffer{}
+		if err := protobufSerializer.Encode(list, &buf); err != nil {
+			abortWithStatus(ctx, err)
+			return
+		}
+		ctx.Data(200, contentType, buf.Bytes())
+		return
+	}
+	data, _ := json.Marshal(list)
+	ctx.Data(200, contentType, data)
+}
+
+func (app *App) aggregatedDiscovery(core bool) *apidiscoveryv2beta1.APIGroupDiscoveryList {
+	groups := make(map[string]map[string][]apidiscoveryv2beta1.APIResourceDiscovery) // group -> version -> resources
+	for gvr, resHandler := range app.handlers() {
+		if (gvr.Group == "") != core {
+			continue
+		}
+		if groups[gvr.Group] == nil {
+			groups[gvr.Group] = make(map[string][]apidiscoveryv2beta1.APIResourceDiscovery)
+		}
+		groups[gvr.Group][gvr.Version] = append(groups[gvr.Group][gvr.Version], resHandler.resourceDiscovery())
+	}
+
+	list := &apidiscoveryv2beta1.APIGroupDiscoveryList{Items: []apidiscoveryv2beta1.APIGroupDiscovery{}}
+	for name, versions := range groups {
+		group := apidiscoveryv2beta1.APIGroupDiscovery{ObjectMeta: metav1.ObjectMeta{Name: name}}
+		for ver, resources := range versions {
+			sort.Slice(resources, func(i, j int) bool { return resources[i].Resource < resources[j].Resource })
+			group.Versions = append(group.Versions, apidiscoveryv2beta1.APIVersionDiscovery{
+				Version: ver, Resources: resources, Freshness: apidiscoveryv2beta1.DiscoveryFreshnessCurrent,
+			})
+		}
+		// 与apiserver一致，首个版本即为preferredVersion
+		sort.Slice(group.Versions, func(i, j int) bool {
+			return version.CompareKubeAwareVersionStrings(group.Versions[i].Version, group.Versions[j].Version) > 0
+		})
+		list.Items = append(list.Items, group)
+	}
+	sort.Slice(list.Items, func(i, j int) bool { return list.Items[i].Name < list.Items[j].Name })
+	return list
+}
+
+func (res *ResourceHandler) resourceDiscovery() apidiscoveryv2beta1.APIResourceDiscovery {
+	scope := apidiscoveryv2beta1.ScopeCluster
+	if res.apiRes.Namespaced {
+		scope = apidiscoveryv2beta1.ScopeNamespace
+	}
+	gvk := res.GVK()
+	rd := apidiscoveryv2beta1.APIResourceDiscovery{
+		Resource:         res.apiRes.Name,
+		ResponseKind:     &metav1.GroupVersionKind{Group: gvk.Group, Version: gvk.Version, Kind: gvk.Kind},
+		Scope:            scope,
+		SingularResource: res.apiRes.SingularName,
+		Verbs:            res.apiRes.Verbs,
+		ShortNames:       res.apiRes.ShortNames,
+		Categories:       res.apiRes.Categories,
+	}
+	for _, sub := range res.subResources {
+		subGVK := &metav1.GroupVersionKind{Group: sub.Group, Version: sub.Version, Kind: sub.Kind}
+		if subGVK.Version == "" {
+			subGVK.Group, subGVK.Version = gvk.Group, gvk.Version
+		}
+		rd.Subresources = append(rd.Subresources, apidiscoveryv2beta1.APISubresourceDiscovery{
+			Subresource:  strings.TrimPrefix(sub.Name, res.apiRes.Name+"/"),
+			ResponseKind: subGVK,
+			Verbs:        sub.Verbs,
+		})
+	}
+	return rd
+}
+
+// 按kube-aware规则降序排列版本，如v2 > v1 > v1beta1 > v1alpha1
+func sortVersions(versions []string) {
+	sort.Slice(versions, func(i, j int) bool {
+		return version.CompareKubeAwareVersionStrings(versions[i], versions[j]) > 0
+	})
+}
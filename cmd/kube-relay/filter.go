@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/anhk/kube-relay/pkg/k8s"
+	"github.com/gin-gonic/gin"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// 根据请求路径及labelSelector/fieldSelector过滤资源对象
+type ResourceFilter struct {
+	Namespace string
+	Name      string
+
+	Label labels.Selector
+	Field fields.Selector
+}
+
+func NewResourceFilter(ctx *gin.Context) (*ResourceFilter, error) {
+	filter := &ResourceFilter{Namespace: ctx.Param("namespace"), Name: ctx.Param("name")}
+
+	var err error
+	if filter.Label, err = labels.Parse(ctx.Query("labelSelector")); err != nil {
+		return nil, apierrors.NewBadRequest(fmt.Sprintf("invalid labelSelector: %v", err))
+	}
+	if filter.Field, err = fields.ParseSelector(ctx.Query("fieldSelector")); err != nil {
+		return nil, apierrors.NewBadRequest(fmt.Sprintf("invalid fieldSelector: %v", err))
+	}
+	return filter, nil
+}
+
+// 请求的namespace及selector，用于校验continue token
+func (f *ResourceFilter) Scope() string {
+	return fmt.Sprintf("%v\x00%v\x00%v", f.Namespace, f.Label, f.Field)
+}
+
+func (f *ResourceFilter) Match(obj runtime.Object) bool {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return false
+	}
+	if f.Namespace != "" && accessor.GetNamespace() != f.Namespace {
+		return false
+	}
+	if f.Name != "" && accessor.GetName() != f.Name {
+		return false
+	}
+	if f.Label != nil && !f.Label.Empty() && !f.Label.Matches(labels.Set(accessor.GetLabels())) {
+		return false
+	}
+	if f.Field != nil && !f.Field.Empty() && !f.Field.Matches(objectFields(obj, f.Field)) {
+		return false
+	}
+	return true
+}
+
+// 根据新旧对象是否匹配转换事件类型，与apiserver的语义保持一致：
+// 对象移出选择范围时返回DELETED，移入时返回ADDED，不相关的事件返回nil
+func (f *ResourceFilter) FilterEvent(it *Item) *metav1.WatchEvent {
+	if it.event.Type != "MODIFIED" || it.oldObj == nil {
+		if f.Match(it.event.Object.Object) {
+			return it.event
+		}
+		return nil
+	}
+
+	curMatch, oldMatch := f.Match(it.event.Object.Object), f.Match(it.oldObj)
+	switch {
+	case curMatch && oldMatch:
+		return it.event
+	case curMatch && !oldMatch:
+		return &metav1.WatchEvent{Type: "ADDED", Object: it.event.Object}
+	case !curMatch && oldMatch:
+		oldObj := it.oldObj.DeepCopyObject()
+		if accessor, err := meta.Accessor(oldObj); err == nil {
+			accessor.SetResourceVersion(resourceVersionOf(it.event.Object.Object))
+		}
+		return &metav1.WatchEvent{Type: "DELETED", Object: runtime.RawExtension{Object: oldObj}}
+	}
+	return nil
+}
+
+// 取出fieldSelector中用到的字段，字段路径与对象的JSON路径一致，如spec.nodeName
+func objectFields(obj runtime.Object, sel fields.Selector) fields.Set {
+	utd, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		utd = k8s.ObjectToUnstructured(obj)
+	}
+
+	set := fields.Set{}
+	for _, req := range sel.Requirements() {
+		val, found, err := unstructured.NestedFieldNoCopy(utd.Object, strings.Split(req.Field, ".")...)
+		if err != nil || !found {
+			continue
+		}
+		set[req.Field] = fmt.Sprint(val)
+	}
+	return set
+}
+
+func resourceVersionOf(obj runtime.Object) string {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return ""
+	}
+	return accessor.GetResourceVersion()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/cache"
+)
+
+// 记录进度的informer：informer的同步进度(LastSyncResourceVersion)在事件进入队列时就会更新，
+// 早于缓存及回调，只有从上游收到的事件都已经过回调送达，同步进度才能作为缓存的版本
+type trackedInformer struct {
+	cache.SharedIndexInformer
+	source    int   // 在FIFO中的序号
+	received  int64 // List及watch收到的最新resourceVersion，不含BOOKMARK
+	delivered int64 // 回调已送达FIFO的最新resourceVersion
+}
+
+func newTrackedInformer(client dynamic.Interface, gvr schema.GroupVersionResource, namespace string, config *ResourceConfig) *trackedInformer {
+	resource := client.Resource(gvr).Namespace(namespace)
+	tweak := config.tweakListOptions()
+	if tweak == nil {
+		tweak = func(*metav1.ListOptions) {}
+	}
+
+	ti := &trackedInformer{}
+	ti.SharedIndexInformer = cache.NewSharedIndexInformer(&cache.ListWatch{
+		ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+			tweak(&opts)
+			list, err := resource.List(context.TODO(), opts)
+			if err == nil {
+				for i := range list.Items {
+					ti.receive(&list.Items[i])
+				}
+			}
+			return list, err
+		},
+		WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+			tweak(&opts)
+			w, err := resource.Watch(context.TODO(), opts)
+			if err != nil {
+				return nil, err
+			}
+			return watch.Filter(w, func(event watch.Event) (watch.Event, bool) {
+				if event.Type != watch.Bookmark && event.Type != watch.Error {
+					ti.receive(event.Object)
+				}
+				return event, true
+			}), nil
+		},
+	}, &unstructured.Unstructured{}, config.resyncPeriod(), cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	return ti
+}
+
+func (ti *trackedInformer) Lister(gvr schema.GroupVersionResource) cache.GenericLister {
+	return cache.NewGenericLister(ti.GetIndexer(), gvr.GroupResource())
+}
+
+func (ti *trackedInformer) receive(obj runtime.Object) {
+	advanceVersion(&ti.received, obj)
+}
+
+// 回调送达FIFO之后调用
+func (ti *trackedInformer) deliver(obj runtime.Object) {
+	advanceVersion(&ti.delivered, obj)
+}
+
+func advanceVersion(version *int64, obj runtime.Object) {
+	rv, err := parseResourceVersion(resourceVersionOf(obj))
+	if err != nil {
+		return
+	}
+	for {
+		old := atomic.LoadInt64(version)
+		if rv <= old || atomic.CompareAndSwapInt64(version, old, rv) {
+			return
+		}
+	}
+}
+
+// 收到的事件都已送达时返回informer的同步进度，其中包括只推进版本的BOOKMARK；否则返回false
+func (ti *trackedInformer) SyncedVersion() (int64, bool) {
+	rv, err := parseResourceVersion(ti.LastSyncResourceVersion()) // 先于received读取，早于它的事件都已计入received
+	if err != nil {
+		return 0, false
+	}
+	if atomic.LoadInt64(&ti.delivered) < atomic.LoadInt64(&ti.received) {
+		return 0, false
+	}
+	return rv, true
+}
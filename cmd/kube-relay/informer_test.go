@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+// 上游最后的事件是删除：列表的resourceVersion比其中的对象新，之后只收到BOOKMARK
+func TestResourceHandlerSyncVersion(t *testing.T) {
+	bookmark := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Query().Get("watch") != "true" {
+			fmt.Fprint(w, `{"kind":"ConfigMapList","apiVersion":"v1","metadata":{"resourceVersion":"20"},"items":[`+
+				`{"kind":"ConfigMap","apiVersion":"v1","metadata":{"name":"a","namespace":"default","resourceVersion":"5"}}]}`)
+			return
+		}
+		w.(http.Flusher).Flush()
+		select {
+		case <-bookmark:
+			fmt.Fprint(w, `{"type":"BOOKMARK","object":{"kind":"ConfigMap","apiVersion":"v1","metadata":{"resourceVersion":"25"}}}`+"\n")
+			w.(http.Flusher).Flush()
+		case <-r.Context().Done():
+			return
+		}
+		<-r.Context().Done()
+	}))
+	defer upstream.Close()
+	defer upstream.CloseClientConnections()
+
+	res := NewResourceHandler(schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}, nil)
+	res.apiRes = metav1.APIResource{Name: "configmaps", Namespaced: true, Kind: "ConfigMap"}
+	synced := res.RunWithDynamicClient(dynamic.NewForConfigOrDie(&rest.Config{Host: upstream.URL}))
+	defer res.Stop()
+
+	stopCh := make(chan struct{})
+	time.AfterFunc(5*time.Second, func() { close(stopCh) })
+	if !cache.WaitForCacheSync(stopCh, synced) {
+		t.Fatal("informer not synced")
+	}
+	if v := res.fifo.Version(); v != "20" {
+		t.Errorf("Version() = %v, want the list resourceVersion 20", v)
+	}
+	if oldest, _ := res.fifo.Window(); oldest != "20" {
+		t.Errorf("oldest = %v, want 20", oldest)
+	}
+
+	close(bookmark)
+	if err := res.fifo.WaitFor(25, 5*time.Second); err != nil {
+		t.Errorf("Version() did not advance on the bookmark: %v", err)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/anhk/kube-relay/pkg/log"
+	"github.com/gin-gonic/gin"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+const (
+	LAZY_SYNC_WAIT     = 10 * time.Second // 首次请求等待informer同步的时间，超时返回503
+	LAZY_MISS_TTL      = time.Minute      // 上游不存在的资源在此期间内不再查询
+	MAX_LAZY_MISSES    = 1024
+	LAZY_IDLE_INTERVAL = time.Minute
+)
+
+// 从请求路径中解析出的资源
+type ResourcePath struct {
+	GVR       schema.GroupVersionResource
+	Namespace string
+	Name      string
+	Watch     bool // 旧式的/watch/前缀
+}
+
+// 解析形如/api/v1/namespaces/{namespace}/{resource}/{name}或/apis/{group}/{version}/watch/{resource}的路径，
+// 不包含子资源
+func parseResourcePath(path string) (*ResourcePath, bool) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	rp := &ResourcePath{}
+	switch {
+	case len(segments) >= 3 && segments[0] == "api":
+		rp.GVR.Version, segments = segments[1], segments[2:]
+	case len(segments) >= 4 && segments[0] == "apis":
+		rp.GVR.Group, rp.GVR.Version, segments = segments[1], segments[2], segments[3:]
+	default:
+		return nil, false
+	}
+
+	if segments[0] == "watch" {
+		rp.Watch, segments = true, segments[1:]
+	}
+	if len(segments) >= 3 && segments[0] == "namespaces" {
+		rp.Namespace, segments = segments[1], segments[2:]
+	}
+	switch len(segments) {
+	case 1:
+		rp.GVR.Resource = segments[0]
+	case 2:
+		rp.GVR.Resource, rp.Name = segments[0], segments[1]
+	default:
+		return nil, false
+	}
+	return rp, rp.GVR.Resource != ""
+}
+
+// 请求对应的鉴权属性，verb为get、list或watch
+func (rp *ResourcePath) ResourceAttributes(ctx *gin.Context) *authorizationv1.ResourceAttributes {
+	attrs := &authorizationv1.ResourceAttributes{Namespace: rp.Namespace, Group: rp.GVR.Group, Version: rp.GVR.Version, Resource: rp.GVR.Resource, Name: rp.Name, Verb: "list"}
+	if watch := ctx.Query("watch"); rp.Watch || watch == "1" || watch == "true" {
+		attrs.Verb = "watch"
+	} else if rp.Name != "" {
+		attrs.Verb = "get"
+	}
+	return attrs
+}
+
+// 处理未注册路由的请求：运行中加入的资源由缓存提供，开启--lazy时上游存在的资源先启动informer，其余交给fallback
+func (app *App) ResourceFunc(fallback gin.HandlerFunc) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if ctx.Request.Method != http.MethodGet {
+			fallback(ctx)
+			return
+		}
+		if gv, ok := app.cachedGroupVersion(ctx.Request.URL.Path); ok {
+			app.APIResourceListByGroupVersion(gv.Group, gv.Version)(ctx)
+			return
+		}
+		rp, ok := parseResourcePath(ctx.Request.URL.Path)
+		if !ok {
+			fallback(ctx)
+			return
+		}
+		// 由缓存提供的请求在启动informer之前鉴权，其余的由上游鉴权
+		if _, ok := app.handler(rp.GVR); (ok || app.lazy) && !app.authorize(ctx, rp) {
+			return
+		}
+		resHandler, err := app.lazyHandler(rp.GVR)
+		if apierrors.IsNotFound(err) || (err == nil && !resHandler.apiRes.Namespaced && rp.Namespace != "") {
+			fallback(ctx)
+			return
+		} else if err != nil {
+			abortWithStatus(ctx, err)
+			return
+		}
+
+		deadline := time.Now().Add(LAZY_SYNC_WAIT)
+		for !resHandler.synced() && time.Now().Before(deadline) {
+			time.Sleep(100 * time.Millisecond)
+		}
+		ctx.Params = append(ctx.Params, gin.Param{Key: "namespace", Value: rp.Namespace}, gin.Param{Key: "name", Value: rp.Name})
+		if rp.Watch {
+			ctx.Set(LEGACY_WATCH_KEY, true)
+		}
+		ctx.Status(http.StatusOK) // gin为NoRoute预设了404，watch的响应头随首次Flush发出
+		resHandler.WatchFunc(ctx) // 仍未同步时返回503及Retry-After
+	}
+}
+
+// 开启--proxy时，缓存提供的请求与转发的请求一样以调用者的权限访问，无权限时返回403并结束请求
+func (app *App) authorize(ctx *gin.Context, rp *ResourcePath) bool {
+	if app.proxy == nil {
+		return true
+	}
+	if err := app.proxy.Authorize(ctx, rp.ResourceAttributes(ctx)); err != nil {
+		abortWithStatus(ctx, err)
+		return false
+	}
+	return true
+}
+
+// /apis/{group}/{version}没有注册路由，发现文档由缓存提供且仍有被中继的资源时在此返回
+func (app *App) cachedGroupVersion(path string) (schema.GroupVersion, bool) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if app.proxy != nil || len(segments) != 3 || segments[0] != "apis" {
+		return schema.GroupVersion{}, false
+	}
+	gv := schema.GroupVersion{Group: segments[1], Version: segments[2]}
+	for gvr := range app.handlers() {
+		if gvr.GroupVersion() == gv {
+			return gv, true
+		}
+	}
+	return gv, false
+}
+
+// 取得资源的handler，不存在且开启--lazy时通过discovery确认后启动informer
+func (app *App) lazyHandler(gvr schema.GroupVersionResource) (*ResourceHandler, error) {
+	if resHandler, ok := app.handler(gvr); ok {
+		return resHandler, nil
+	}
+	if !app.lazy {
+		return nil, apierrors.NewNotFound(gvr.GroupResource(), "")
+	}
+	if _, ok := app.lazyMisses.Get(gvr); ok {
+		return nil, apierrors.NewNotFound(gvr.GroupResource(), "")
+	}
+
+	val, err, _ := app.lazyGroup.Do(gvr.String(), func() (any, error) {
+		if resHandler, ok := app.handler(gvr); ok {
+			return resHandler, nil
+		}
+		resHandler := NewResourceHandler(gvr, nil)
+		err := resHandler.GetInfoByKubeClient(app.kubeClient)
+		if err == nil && !sets.NewString(resHandler.apiRes.Verbs...).HasAll("list", "watch") {
+			err = fmt.Errorf("%v does not support list and watch", gvr)
+		}
+		if err != nil {
+			log.Debug("%v is not served by upstream: %v", gvr, err)
+			app.lazyMisses.Add(gvr, struct{}{}, LAZY_MISS_TTL)
+			return nil, apierrors.NewNotFound(gvr.GroupResource(), "")
+		}
+		resHandler.LoadTableColumns(app.dynamicClient)
+		resHandler.lazy = true
+		resHandler.RunWithDynamicClient(app.dynamicClient)
+		app.addHandler(resHandler)
+		log.Info("start informer for %v on demand", gvr)
+		return resHandler, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return val.(*ResourceHandler), nil
+}
+
+// 定期停止空闲超过idleTimeout的按需informer
+func (app *App) StopIdleHandlers(idleTimeout time.Duration) {
+	interval := LAZY_IDLE_INTERVAL
+	if idleTimeout < interval {
+		interval = idleTimeout
+	}
+	for range time.Tick(interval) {
+		for gvr, resHandler := range app.handlers() {
+			if _, ok := app.staticConfig(gvr); ok || !resHandler.lazy || resHandler.Idle() < idleTimeout { // 热加载后加入配置的资源不再停止
+				continue
+			}
+			app.removeHandler(gvr)
+			log.Info("stop idle informer for %v", gvr)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
+)
+
+// 每个namespace一个informer时，合并各自的lister；未配置的namespace中没有对象
+type namespacedLister struct {
+	resource schema.GroupResource
+	listers  map[string]cache.GenericLister // namespace -> lister
+}
+
+func (l *namespacedLister) List(selector labels.Selector) ([]runtime.Object, error) {
+	var result []runtime.Object
+	for _, lister := range l.listers {
+		list, err := lister.List(selector)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, list...)
+	}
+	return result, nil
+}
+
+// key为<namespace>/<name>
+func (l *namespacedLister) Get(key string) (runtime.Object, error) {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return l.ByNamespace(namespace).Get(name)
+}
+
+func (l *namespacedLister) ByNamespace(namespace string) cache.GenericNamespaceLister {
+	if lister, ok := l.listers[namespace]; ok {
+		return lister.ByNamespace(namespace)
+	}
+	return emptyNamespaceLister{resource: l.resource}
+}
+
+type emptyNamespaceLister struct {
+	resource schema.GroupResource
+}
+
+func (l emptyNamespaceLister) List(selector labels.Selector) ([]runtime.Object, error) {
+	return nil, nil
+}
+
+func (l emptyNamespaceLister) Get(name string) (runtime.Object, error) {
+	return nil, apierrors.NewNotFound(l.resource, name)
+}
@@ -1,32 +1,161 @@
 package main
 
 import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/anhk/kube-relay/pkg/k8s"
 	"github.com/anhk/kube-relay/pkg/log"
 	"github.com/spf13/cobra"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 )
 
 var option = Option{}
 
 var rootCmd = &cobra.Command{
 	Use:          "kube-relay, to reduce the pressure of kube-apiserver when lot's of apps subscribing it",
-	Example:      "  kube-relay --resources services,endpointslice.discovery.k8s.io/v1",
+	Example:      "  kube-relay --resources svc,endpointslice.discovery.k8s.io/v1\n  kube-relay --resources '*.discovery.k8s.io,networking.k8s.io/*,-ingressclasses.networking.k8s.io'",
 	SilenceUsage: true,
 	RunE: func(cmd *cobra.Command, args []string) error {
+		if option.ConfigFile != "" && option.ConfigObject != "" {
+			return fmt.Errorf("--config and --config-object are mutually exclusive")
+		}
+		flagOption := option // 热加载时以命令行参数为基础重新合并配置
+		if err := loadConfig(cmd, &option); err != nil {
+			return err
+		}
+		if err := loadConfigObject(cmd, &option); err != nil {
+			return err
+		}
+		if err := option.Validate(); err != nil {
+			return err
+		}
+		option.ReloadResources = func() ([]ResourceConfig, error) {
+			next := flagOption
+			if err := loadConfig(cmd, &next); err != nil {
+				return nil, err
+			}
+			if err := loadConfigObject(cmd, &next); err != nil {
+				return nil, err
+			}
+			return next.ResourceConfigs(), nil
+		}
+		option.ApplyConfig = func(conf *RelayConfig) []ResourceConfig {
+			next := flagOption
+			conf.ApplyTo(&next, cmd.Flags())
+			return next.ResourceConfigs()
+		}
 		return NewApp().Run(&option)
 	},
 }
 
+var offline bool
+
+var validateConfigCmd = &cobra.Command{
+	Use:          "validate-config",
+	Short:        "check the file given by --config and print the resources it resolves to",
+	Example:      "  kube-relay validate-config --config relay.yaml --kubeconfig ~/.kube/config",
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if option.ConfigFile == "" {
+			return fmt.Errorf("--config is required")
+		}
+		if err := loadConfig(cmd, &option); err != nil {
+			return err
+		}
+		if offline {
+			fmt.Fprintf(cmd.OutOrStdout(), "%v is valid\n", option.ConfigFile)
+			return nil
+		}
+		kubeClient, err := k8s.CreateKubeClient(option.KubeConfig, option.ApiServer)
+		if err != nil {
+			return err
+		}
+		resources, err := resolveResourceConfigs(kubeClient.Discovery(), option.ResourceConfigs())
+		if err != nil {
+			return err
+		}
+		for _, res := range resources {
+			fmt.Fprintf(cmd.OutOrStdout(), "%v\t<- %v\n", res.GVR, res.Config.Name)
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "%v is valid, %d resources\n", option.ConfigFile, len(resources))
+		return nil
+	},
+}
+
+// 读取--config指定的配置文件
+func loadConfig(cmd *cobra.Command, option *Option) error {
+	if option.ConfigFile == "" {
+		return nil
+	}
+	conf, err := LoadConfig(option.ConfigFile)
+	if err != nil {
+		return err
+	}
+	conf.ApplyTo(option, cmd.Flags())
+	return nil
+}
+
+// 读取--config-object指定的RelayConfig对象，对象不存在时只使用命令行参数，创建后再加载
+func loadConfigObject(cmd *cobra.Command, option *Option) error {
+	if option.ConfigObject == "" {
+		return nil
+	}
+	namespace, name, err := splitConfigObject(option.ConfigObject)
+	if err != nil {
+		return err
+	}
+	client, err := k8s.CreateDynamicClient(option.KubeConfig, option.ApiServer)
+	if err != nil {
+		return err
+	}
+	conf, err := LoadConfigObject(client, namespace, name)
+	if apierrors.IsNotFound(err) {
+		log.Warn("RelayConfig %v/%v not found, start with command line flags", namespace, name)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	conf.ApplyTo(option, cmd.Flags())
+	return nil
+}
+
 func main() {
 	rootCmd.PersistentFlags().StringVar(&option.KubeConfig, "kubeconfig", "", "kubeconfig file")
 	rootCmd.PersistentFlags().StringVar(&option.ApiServer, "apiserver", "", "the address of apiserver")
+	rootCmd.PersistentFlags().StringVar(&option.ConfigFile, "config", "", "YAML configuration file with global and per-resource settings, flags given on the command line take precedence")
+	rootCmd.PersistentFlags().StringVar(&option.ConfigObject, "config-object", "", "read the configuration from a RelayConfig object, as <namespace>/<name>, and apply its changes live")
+	rootCmd.PersistentFlags().Float32Var(&k8s.QPS, "qps", k8s.QPS, "QPS to the apiserver")
+	rootCmd.PersistentFlags().IntVar(&k8s.Burst, "burst", k8s.Burst, "burst to the apiserver")
 	rootCmd.PersistentFlags().Uint16Var(&option.Port, "port", 8443, "listen port")
+	rootCmd.PersistentFlags().BoolVar(&option.Proxy, "proxy", false, "reverse-proxy requests not served from cache to apiserver, impersonating the caller")
+	rootCmd.PersistentFlags().DurationVar(&option.ProxyCacheTTL, "proxy-cache-ttl", 0, "cache proxied GET responses for this long and coalesce identical concurrent requests, 0 to disable")
+	rootCmd.PersistentFlags().StringVar(&option.AdminListen, "admin-listen", "", "serve the admin API on this address, e.g. 127.0.0.1:8444, disabled if empty")
+	rootCmd.PersistentFlags().StringVar(&option.AdminTokenFile, "admin-token-file", "", "file holding the bearer token required by the admin API")
+	rootCmd.PersistentFlags().BoolVar(&option.Lazy, "lazy", false, "start informers on demand for resources requested by clients but not listed in --resources, requires --proxy")
+	rootCmd.PersistentFlags().DurationVar(&option.LazyIdleTimeout, "lazy-idle-timeout", 10*time.Minute, "stop an on-demand informer after it has had no watchers for this long")
 
 	rootCmd.PersistentFlags().StringArrayVar(&option.ResourceNames, "resources", []string{
 		"services",
 		"endpointslices.discovery.k8s.io/v1",
 		"federalendpoints.dlb.jdt.com/v1",
-	}, "resources to relay")
+	}, "resources to relay, as <resource>[.<group>][/<version>]; short names, kinds and wildcards are resolved through discovery, a leading - excludes")
+	rootCmd.PersistentFlags().StringArrayVar(&option.CRDGroups, "crd-groups", nil, "relay CustomResourceDefinitions whose group matches these patterns as they are created, e.g. *.example.com")
+
+	log.SetLevel(log.LEVEL_INFO)
+	rootCmd.PersistentFlags().VarP(log.LevelValue{}, "verbose", "v", "log level")
+
+	validateConfigCmd.Flags().BoolVar(&offline, "offline", false, "only check the file itself, without resolving resources through discovery")
+	rootCmd.AddCommand(validateConfigCmd)
 
-	rootCmd.PersistentFlags().IntVarP(&log.Level, "verbose", "v", log.LEVEL_INFO, "log level")
-	rootCmd.Execute()
+	ctlCmd.PersistentFlags().StringVar(&ctlServer, "server", "http://127.0.0.1:8444", "address of the relay's admin API")
+	ctlAddCmd.Flags().IntVar(&ctlFIFOSize, "fifo-size", 0, "number of watch events to keep, 0 for the default")
+	ctlAddCmd.Flags().DurationVar(&ctlResyncPeriod, "resync-period", 0, "informer resync period, 0 for the default")
+	ctlCmd.AddCommand(ctlResourcesCmd, ctlAddCmd, ctlRemoveCmd, ctlRelistCmd, ctlWatchersCmd, ctlDisconnectCmd, ctlLogLevelCmd)
+	rootCmd.AddCommand(ctlCmd)
+	if err := rootCmd.Execute(); err != nil {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// 只保留TypeMeta及ObjectMeta
+func toPartialObjectMetadata(obj runtime.Object) *metav1.PartialObjectMetadata {
+	pom := &metav1.PartialObjectMetadata{}
+	switch t := obj.(type) {
+	case *unstructured.Unstructured:
+		if m, ok := t.Object["metadata"].(map[string]any); ok {
+			_ = runtime.DefaultUnstructuredConverter.FromUnstructured(m, &pom.ObjectMeta)
+		}
+	case metav1.ObjectMetaAccessor:
+		if objMeta, ok := t.GetObjectMeta().(*metav1.ObjectMeta); ok {
+			objMeta.DeepCopyInto(&pom.ObjectMeta)
+		}
+	}
+	pom.APIVersion = "meta.k8s.io/v1"
+	pom.Kind = "PartialObjectMetadata"
+	return pom
+}
+
+// 只输出元数据，对应Accept: application/json;as=PartialObjectMetadata;g=meta.k8s.io;v=v1
+// 以及PartialObjectMetadataList，编码方式由内层的codec决定
+type metadataCodec struct {
+	ResponseCodec
+}
+
+func (c *metadataCodec) WriteObject(ctx *gin.Context, code int, obj runtime.Object) {
+	switch t := obj.(type) {
+	case *metav1.Status:
+		c.ResponseCodec.WriteObject(ctx, code, obj)
+	case *ListWrapper:
+		list := &metav1.PartialObjectMetadataList{ListMeta: t.Metadata, Items: make([]metav1.PartialObjectMetadata, 0, len(t.Items))}
+		list.APIVersion = "meta.k8s.io/v1"
+		list.Kind = "PartialObjectMetadataList"
+		for _, item := range t.Items {
+			list.Items = append(list.Items, *toPartialObjectMetadata(item))
+		}
+		c.ResponseCodec.WriteObject(ctx, code, list)
+	default:
+		c.ResponseCodec.WriteObject(ctx, code, toPartialObjectMetadata(obj))
+	}
+}
+
+func (c *metadataCodec) WriteEvent(ctx *gin.Context, event *metav1.WatchEvent) {
+	if event.Type != "ERROR" {
+		event = &metav1.WatchEvent{Type: event.Type, Object: runtime.RawExtension{Object: toPartialObjectMetadata(event.Object.Object)}}
+	}
+	c.ResponseCodec.WriteEvent(ctx, event)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"crypto/sha512"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anhk/kube-relay/pkg/log"
+	"github.com/gin-gonic/gin"
+	openapi_v2 "github.com/google/gnostic-models/openapiv2"
+	"google.golang.org/protobuf/proto"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/kube-openapi/pkg/handler3"
+)
+
+const (
+	OPENAPI_REFRESH_INTERVAL = 10 * time.Minute
+
+	MIME_OPENAPI_V2_PROTOBUF = "application/com.github.proto-openapi.spec.v2@v1.0+protobuf"
+	MIME_OPENAPI_V3_PROTOBUF = "application/com.github.proto-openapi.spec.v3@v1.0+protobuf"
+)
+
+// 缓存上游apiserver的/version及OpenAPI文档，文档中只保留被中继的资源
+type OpenAPICache struct {
+	mu sync.RWMutex
+
+	version []byte
+	v2      []byte
+	v2pb    []byte
+	v3Index []byte
+	v3      map[string][]byte // key: api/v1, apis/<group>/<version>
+	v3pb    map[string][]byte
+}
+
+func NewOpenAPICache() *OpenAPICache {
+	return &OpenAPICache{}
+}
+
+// 从上游拉取全部文档，任一文档失败不影响其它文档
+func (c *OpenAPICache) Refresh(kubeClient *kubernetes.Clientset, gvrs []schema.GroupVersionResource) {
+	restClient := kubeClient.DiscoveryClient.RESTClient()
+	fetch := func(path string) ([]byte, error) {
+		return restClient.Get().AbsPath(path).SetHeader("Accept", MIME_JSON).DoRaw(context.Background())
+	}
+
+	version, err := fetch("/version")
+	if err != nil {
+		log.Warn("fetch /version failed: %v", err)
+	}
+
+	var v2, v2pb []byte
+	if data, err := fetch("/openapi/v2"); err != nil {
+		log.Warn("fetch /openapi/v2 failed: %v", err)
+	} else if v2, err = filterOpenAPIV2(data, gvrs); err != nil {
+		log.Warn("filter /openapi/v2 failed: %v", err)
+	} else if v2pb, err = toV2ProtoBinary(v2); err != nil {
+		log.Warn("convert /openapi/v2 to protobuf failed: %v", err)
+	}
+
+	v3Index, v3, v3pb, err := c.fetchOpenAPIV3(fetch, gvrs)
+	if err != nil {
+		log.Warn("fetch /openapi/v3 failed: %v", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if version != nil {
+		c.version = version
+	}
+	if v2 != nil {
+		c.v2, c.v2pb = v2, v2pb
+	}
+	if v3Index != nil {
+		c.v3Index, c.v3, c.v3pb = v3Index, v3, v3pb
+	}
+}
+
+func (c *OpenAPICache) fetchOpenAPIV3(fetch func(string) ([]byte, error), gvrs []schema.GroupVersionResource) ([]byte, map[string][]byte, map[string][]byte, error) {
+	data, err := fetch("/openapi/v3")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	upstream := handler3.OpenAPIV3Discovery{}
+	if err := json.Unmarshal(data, &upstream); err != nil {
+		return nil, nil, nil, err
+	}
+
+	index := handler3.OpenAPIV3Discovery{Paths: make(map[string]handler3.OpenAPIV3DiscoveryGroupVersion)}
+	v3, v3pb := make(map[string][]byte), make(map[string][]byte)
+	for _, gvr := range gvrs {
+		key := openAPIV3Key(gvr.GroupVersion())
+		item, ok := upstream.Paths[key]
+		if !ok || v3[key] != nil {
+			continue
+		}
+		data, err := fetch(strings.SplitN(item.ServerRelativeURL, "?", 2)[0])
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if v3[key], err = filterOpenAPIV3(data, gvrs); err != nil {
+			return nil, nil, nil, err
+		}
+		if v3pb[key], err = handler3.ToV3ProtoBinary(v3[key]); err != nil {
+			log.Warn("convert /openapi/v3/%v to protobuf failed: %v", key, err)
+		}
+		index.Paths[key] = handler3.OpenAPIV3DiscoveryGroupVersion{
+			ServerRelativeURL: fmt.Sprintf("/openapi/v3/%v?hash=%X", key, sha512.Sum512(v3[key])),
+		}
+	}
+	indexData, err := json.Marshal(&index)
+	return indexData, v3, v3pb, err
+}
+
+func openAPIV3Key(gv schema.GroupVersion) string {
+	if gv.Group == "" {
+		return "api/" + gv.Version
+	}
+	return fmt.Sprintf("apis/%v/%v", gv.Group, gv.Version)
+}
+
+func (c *OpenAPICache) VersionFunc(ctx *gin.Context) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	c.write(ctx, MIME_JSON, c.version)
+}
+
+func (c *OpenAPICache) V2Func(ctx *gin.Context) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if strings.Contains(ctx.GetHeader("Accept"), MIME_OPENAPI_V2_PROTOBUF) && c.v2pb != nil {
+		c.write(ctx, MIME_OPENAPI_V2_PROTOBUF, c.v2pb)
+	} else {
+		c.write(ctx, MIME_JSON, c.v2)
+	}
+}
+
+func (c *OpenAPICache) V3IndexFunc(ctx *gin.Context) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	c.write(ctx, MIME_JSON, c.v3Index)
+}
+
+func (c *OpenAPICache) V3Func(ctx *gin.Context) {
+	key := strings.Trim(ctx.Param("gv"), "/")
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if _, ok := c.v3[key]; !ok {
+		notFound(ctx)
+		return
+	}
+	if strings.Contains(ctx.GetHeader("Accept"), MIME_OPENAPI_V3_PROTOBUF) && c.v3pb[key] != nil {
+		c.write(ctx, MIME_OPENAPI_V3_PROTOBUF, c.v3pb[key])
+	} else {
+		c.write(ctx, MIME_JSON, c.v3[key])
+	}
+}
+
+func (c *OpenAPICache) write(ctx *gin.Context, contentType string, data []byte) {
+	if data == nil {
+		abortWithStatus(ctx, apierrors.NewServiceUnavailable("not yet fetched from upstream"))
+		return
+	}
+	ctx.Data(200, contentType, data)
+}
+
+// 判断OpenAPI中的路径是否属于被中继的资源，只保留资源本身，不包含子资源
+func isRelayedPath(path string, gvrs []schema.GroupVersionResource) bool {
+	for _, gvr := range gvrs {
+		prefix := "/" + openAPIV3Key(gvr.GroupVersion())
+		if !strings.HasPrefix(path, prefix+"/") {
+			continue
+		}
+		rest := strings.TrimPrefix(path, prefix)
+		rest = strings.TrimPrefix(rest, "/watch")
+		rest = strings.TrimPrefix(rest, "/namespaces/{namespace}")
+		segments := strings.Split(strings.Trim(rest, "/"), "/")
+		if segments[0] == gvr.Resource && len(segments) <= 2 {
+			return true
+		}
+	}
+	return false
+}
+
+// 收集所有以prefix开头的$ref
+func collectRefs(v any, prefix string, refs *[]string) {
+	switch t := v.(type) {
+	case map[string]any:
+		for key, val := range t {
+			if ref, ok := val.(string); ok && key == "$ref" && strings.HasPrefix(ref, prefix) {
+				*refs = append(*refs, strings.TrimPrefix(ref, prefix))
+			} else {
+				collectRefs(val, prefix, refs)
+			}
+		}
+	case []any:
+		for _, val := range t {
+			collectRefs(val, prefix, refs)
+		}
+	}
+}
+
+// 只保留paths及其引用(直接或间接)到的定义
+func filterPaths(doc map[string]any, gvrs []schema.GroupVersionResource, defs map[string]any, prefix string) map[string]any {
+	paths, _ := doc["paths"].(map[string]any)
+	keptPaths := make(map[string]any)
+	for path, val := range paths {
+		if isRelayedPath(path, gvrs) {
+			keptPaths[path] = val
+		}
+	}
+	doc["paths"] = keptPaths
+
+	var queue []string
+	collectRefs(keptPaths, prefix, &queue)
+	keptDefs := make(map[string]any)
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		if _, ok := keptDefs[name]; ok {
+			continue
+		}
+		if def, ok := defs[name]; ok {
+			keptDefs[name] = def
+			collectRefs(def, prefix, &queue)
+		}
+	}
+	return keptDefs
+}
+
+func filterOpenAPIV2(data []byte, gvrs []schema.GroupVersionResource) ([]byte, error) {
+	var doc map[string]any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	defs, _ := doc["definitions"].(map[string]any)
+	doc["definitions"] = filterPaths(doc, gvrs, defs, "#/definitions/")
+	return json.Marshal(doc)
+}
+
+func toV2ProtoBinary(data []byte) ([]byte, error) {
+	document, err := openapi_v2.ParseDocument(data)
+	if err != nil {
+		return nil, err
+	}
+	return proto.Marshal(document)
+}
+
+func filterOpenAPIV3(data []byte, gvrs []schema.GroupVersionResource) ([]byte, error) {
+	var doc map[string]any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	components, _ := doc["components"].(map[string]any)
+	if components == nil {
+		components = make(map[string]any)
+		doc["components"] = components
+	}
+	schemas, _ := components["schemas"].(map[string]any)
+	components["schemas"] = filterPaths(doc, gvrs, schemas, "#/components/schemas/")
+	return json.Marshal(doc)
+}
@@ -1,9 +1,67 @@
 package main
 
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
 type Option struct {
 	KubeConfig string
 	ApiServer  string
 
+	ConfigFile   string // 声明式配置文件，命令行中显式指定的参数优先
+	ConfigObject string // 集群中的RelayConfig对象，<namespace>/<name>，变化时热加载
+
 	ResourceNames []string
-	Port          uint16 // Listen Port
+	Resources     []ResourceConfig // 配置文件中的资源，为空时由ResourceNames生成
+	CRDGroups     []string         // 自动中继group匹配的CRD，支持通配符
+	Port          uint16           // Listen Port
+	Listen        []string         // 侦听地址，为空时侦听Port
+	Proxy         bool             // 缓存之外的请求转发到上游apiserver
+	ProxyCacheTTL time.Duration    // 转发的GET请求的缓存时间，0表示不缓存
+
+	AdminListen    string // 管理接口的侦听地址，为空时不开启
+	AdminTokenFile string // 管理接口的Bearer token
+
+	Lazy            bool          // 按需启动未在ResourceNames中的资源
+	LazyIdleTimeout time.Duration // 按需启动的资源没有watch后保留的时间
+
+	ReloadResources func() ([]ResourceConfig, error)         // 重新读取被中继的资源，用于热加载
+	ApplyConfig     func(conf *RelayConfig) []ResourceConfig // 将配置与命令行参数合并，返回被中继的资源
+}
+
+// 检查合并配置文件后的参数
+func (option *Option) Validate() error {
+	if option.Lazy && !option.Proxy { // 没有--proxy时无法以调用者的权限鉴权
+		return fmt.Errorf("--lazy requires --proxy")
+	}
+	if option.LazyIdleTimeout <= 0 { // 否则空闲的informer永远不会停止
+		return fmt.Errorf("--lazy-idle-timeout must be positive")
+	}
+	return nil
+}
+
+// 被中继的资源配置，--resources中每一项(逗号分隔)对应一条默认配置
+func (option *Option) ResourceConfigs() []ResourceConfig {
+	if len(option.Resources) > 0 {
+		return option.Resources
+	}
+	var configs []ResourceConfig
+	for _, names := range option.ResourceNames {
+		for _, name := range strings.Split(names, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				configs = append(configs, ResourceConfig{Name: name})
+			}
+		}
+	}
+	return configs
+}
+
+// 侦听地址
+func (option *Option) ListenAddrs() []string {
+	if len(option.Listen) > 0 {
+		return option.Listen
+	}
+	return []string{fmt.Sprintf(":%v", option.Port)}
 }
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/cache"
+)
+
+const (
+	MAX_LIST_SNAPSHOTS = 1024
+	LIST_SNAPSHOT_TTL  = 5 * time.Minute // 与apiserver的continue token有效期一致
+)
+
+// 某一时刻的列表快照，分页请求都从同一快照中读取
+type ListSnapshot struct {
+	version string
+	scope   string // 生成快照的请求范围，continue token只能用于相同范围的请求
+	items   []runtime.Object
+}
+
+type continueToken struct {
+	ID     string `json:"id"`
+	Offset int    `json:"offset"`
+}
+
+// 为分页列表保存快照
+type ListPager struct {
+	snapshots *cache.LRUExpireCache
+}
+
+func NewListPager() *ListPager {
+	return &ListPager{snapshots: cache.NewLRUExpireCache(MAX_LIST_SNAPSHOTS)}
+}
+
+// 对象按namespace/name排序，保证分页顺序稳定
+func sortObjects(items []runtime.Object) {
+	key := func(obj runtime.Object) string {
+		accessor, err := meta.Accessor(obj)
+		if err != nil {
+			return ""
+		}
+		return accessor.GetNamespace() + "/" + accessor.GetName()
+	}
+	sort.Slice(items, func(i, j int) bool { return key(items[i]) < key(items[j]) })
+}
+
+// 取一页数据，返回当前页、下一页的continue token以及剩余对象数
+func (pager *ListPager) Page(snapshot *ListSnapshot, id string, offset int, limit int64) ([]runtime.Object, string, int64) {
+	end := len(snapshot.items)
+	if limit > 0 && int64(end-offset) > limit {
+		end = offset + int(limit)
+	}
+	page := snapshot.items[offset:end]
+	if end == len(snapshot.items) {
+		return page, "", 0
+	}
+
+	if id == "" {
+		id = newSnapshotID()
+		pager.snapshots.Add(id, snapshot, LIST_SNAPSHOT_TTL)
+	}
+	data, _ := json.Marshal(&continueToken{ID: id, Offset: end})
+	return page, base64.RawURLEncoding.EncodeToString(data), int64(len(snapshot.items) - end)
+}
+
+// 快照ID不可预测，避免猜测其他请求的continue token
+func newSnapshotID() string {
+	buf := make([]byte, 16)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// 根据continue token找到对应的快照，scope与生成快照的请求不同时返回400
+func (pager *ListPager) Continue(token, scope string) (*ListSnapshot, string, int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, "", 0, apierrors.NewBadRequest("invalid continue token")
+	}
+	var ct continueToken
+	if err := json.Unmarshal(data, &ct); err != nil || ct.ID == "" || ct.Offset < 0 {
+		return nil, "", 0, apierrors.NewBadRequest("invalid continue token")
+	}
+
+	val, ok := pager.snapshots.Get(ct.ID)
+	if !ok {
+		return nil, "", 0, apierrors.NewResourceExpired("the provided continue parameter is too old to display a consistent list result. You can start a new list without the continue parameter")
+	}
+	snapshot := val.(*ListSnapshot)
+	if snapshot.scope != scope {
+		return nil, "", 0, apierrors.NewBadRequest("continue token does not match the namespace or selectors of the request")
+	}
+	if ct.Offset > len(snapshot.items) {
+		return nil, "", 0, apierrors.NewBadRequest("invalid continue token")
+	}
+	return snapshot, ct.ID, ct.Offset, nil
+}
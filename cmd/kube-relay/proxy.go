@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/anhk/kube-relay/pkg/log"
+	"github.com/gin-gonic/gin"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/cache"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	MAX_TOKEN_REVIEWS  = 4096
+	TOKEN_REVIEW_TTL   = 10 * time.Second
+	MAX_ACCESS_REVIEWS = 4096
+	ACCESS_REVIEW_TTL  = 10 * time.Second
+)
+
+// 匿名用户，与apiserver的--anonymous-auth一致
+var anonymousUser = authenticationv1.UserInfo{Username: "system:anonymous", Groups: []string{"system:unauthenticated"}}
+
+// 将缓存之外的请求转发到上游apiserver：调用者的token通过TokenReview确认身份，
+// 再以relay自身的凭据加impersonation头转发，relay的账号需要impersonate权限；
+// 开启--lazy时还需要创建subjectaccessreviews的权限
+type UpstreamProxy struct {
+	kubeClient   *kubernetes.Clientset
+	proxy        *httputil.ReverseProxy
+	upgradeProxy *httputil.ReverseProxy // exec、attach、portforward
+	users        *cache.LRUExpireCache  // key: token的sha256
+	decisions    *cache.LRUExpireCache  // SubjectAccessReview的结果，key: 身份及请求属性的sha256
+	cache        *ResponseCache         // 为nil时不缓存
+}
+
+// cacheTTL大于0时缓存GET请求的响应
+func NewUpstreamProxy(config *rest.Config, kubeClient *kubernetes.Clientset, cacheTTL time.Duration) (*UpstreamProxy, error) {
+	target, _, err := rest.DefaultServerUrlFor(config)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := rest.TransportFor(config)
+	if err != nil {
+		return nil, err
+	}
+	// 协议升级只能在HTTP/1.1上进行，SPDY升级不会被net/http自动降级，需要单独的连接
+	upgradeConfig := rest.CopyConfig(config)
+	upgradeConfig.NextProtos = []string{"http/1.1"}
+	upgradeTransport, err := rest.TransportFor(upgradeConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &UpstreamProxy{
+		kubeClient:   kubeClient,
+		proxy:        newReverseProxy(target, transport),
+		upgradeProxy: newReverseProxy(target, upgradeTransport),
+		users:        cache.NewLRUExpireCache(MAX_TOKEN_REVIEWS),
+		decisions:    cache.NewLRUExpireCache(MAX_ACCESS_REVIEWS),
+	}
+	if cacheTTL > 0 {
+		p.cache = NewResponseCache(cacheTTL)
+	}
+	return p, nil
+}
+
+// 升级后的连接由ReverseProxy通过Hijack双向转发，logs -f等长连接响应每次写入都立即刷新
+func newReverseProxy(target *url.URL, transport http.RoundTripper) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(target)
+			r.Out.Host = target.Host
+		},
+		Transport:     transport,
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Warn("proxy %v %v failed: %v", r.Method, r.URL.Path, err)
+			status := errorStatus(apierrors.NewServiceUnavailable(fmt.Sprintf("upstream unavailable: %v", err)))
+			data, _ := json.Marshal(status)
+			w.Header().Set("Content-Type", MIME_JSON)
+			w.WriteHeader(int(status.Code))
+			w.Write(data)
+		},
+	}
+}
+
+// 请求是否需要协议升级(SPDY/WebSocket)，如exec、attach、portforward
+func isUpgradeRequest(req *http.Request) bool {
+	for _, val := range req.Header.Values("Connection") {
+		for _, token := range strings.Split(val, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 转发请求
+func (p *UpstreamProxy) ProxyFunc(ctx *gin.Context) {
+	for key := range ctx.Request.Header { // 不允许调用者自行指定impersonation
+		if strings.HasPrefix(http.CanonicalHeaderKey(key), "Impersonate-") {
+			abortWithStatus(ctx, apierrors.NewForbidden(schema.GroupResource{}, "", fmt.Errorf("impersonation is not allowed through the relay")))
+			return
+		}
+	}
+
+	user, err := p.authenticate(ctx)
+	if err != nil {
+		abortWithStatus(ctx, err)
+		return
+	}
+
+	header := ctx.Request.Header
+	header.Del("Authorization") // 使用relay自身的凭据
+	header.Set(authenticationv1.ImpersonateUserHeader, user.Username)
+	if user.UID != "" {
+		header.Set(authenticationv1.ImpersonateUIDHeader, user.UID)
+	}
+	for _, group := range user.Groups {
+		header.Add(authenticationv1.ImpersonateGroupHeader, group)
+	}
+	for key, values := range user.Extra {
+		for _, val := range values {
+			header.Add(authenticationv1.ImpersonateUserExtraHeaderPrefix+url.PathEscape(key), val)
+		}
+	}
+	if isUpgradeRequest(ctx.Request) {
+		p.upgradeProxy.ServeHTTP(ctx.Writer, ctx.Request)
+		return
+	}
+	if p.cache != nil && cacheableRequest(ctx.Request) {
+		p.cache.ServeHTTP(ctx, user, p.proxy)
+		return
+	}
+	p.proxy.ServeHTTP(ctx.Writer, ctx.Request)
+}
+
+// 通过TokenReview确认调用者身份，没有token的请求作为匿名用户
+func (p *UpstreamProxy) authenticate(ctx *gin.Context) (*authenticationv1.UserInfo, error) {
+	auth := ctx.GetHeader("Authorization")
+	if auth == "" {
+		return &anonymousUser, nil
+	}
+	token, ok := strings.CutPrefix(auth, "Bearer ")
+	if !ok || token == "" {
+		return nil, apierrors.NewUnauthorized("only bearer tokens are supported")
+	}
+
+	key := fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
+	if user, ok := p.users.Get(key); ok {
+		return user.(*authenticationv1.UserInfo), nil
+	}
+	review, err := p.kubeClient.AuthenticationV1().TokenReviews().Create(ctx, &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if !review.Status.Authenticated {
+		return nil, apierrors.NewUnauthorized(review.Status.Error)
+	}
+	p.users.Add(key, &review.Status.User, TOKEN_REVIEW_TTL)
+	return &review.Status.User, nil
+}
+
+// 确认调用者有权访问资源：按需启动的资源由缓存提供，不经过上游的鉴权，需要通过SubjectAccessReview检查
+func (p *UpstreamProxy) Authorize(ctx *gin.Context, attrs *authorizationv1.ResourceAttributes) error {
+	user, err := p.authenticate(ctx)
+	if err != nil {
+		return err
+	}
+	identity, _ := json.Marshal(user)
+	request, _ := json.Marshal(attrs)
+	key := fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprintf("%s\n%s", identity, request))))
+
+	status, ok := p.decisions.Get(key)
+	if !ok {
+		spec := authorizationv1.SubjectAccessReviewSpec{ResourceAttributes: attrs, User: user.Username, UID: user.UID, Groups: user.Groups}
+		if len(user.Extra) > 0 {
+			spec.Extra = make(map[string]authorizationv1.ExtraValue, len(user.Extra))
+			for key, values := range user.Extra {
+				spec.Extra[key] = authorizationv1.ExtraValue(values)
+			}
+		}
+		review, err := p.kubeClient.AuthorizationV1().SubjectAccessReviews().Create(ctx, &authorizationv1.SubjectAccessReview{Spec: spec}, metav1.CreateOptions{})
+		if err != nil {
+			return err
+		}
+		status = &review.Status
+		p.decisions.Add(key, status, ACCESS_REVIEW_TTL)
+	}
+	if review := status.(*authorizationv1.SubjectAccessReviewStatus); !review.Allowed || review.Denied {
+		scope := "at the cluster scope"
+		if attrs.Namespace != "" {
+			scope = fmt.Sprintf("in the namespace %q", attrs.Namespace)
+		}
+		reason := fmt.Sprintf("User %q cannot %v resource %q in API group %q %v", user.Username, attrs.Verb, attrs.Resource, attrs.Group, scope)
+		if review.Reason != "" {
+			reason += ": " + review.Reason
+		}
+		return apierrors.NewForbidden(schema.GroupResource{Group: attrs.Group, Resource: attrs.Resource}, attrs.Name, fmt.Errorf("%v", reason))
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/anhk/kube-relay/pkg/singleflight"
+	"github.com/gin-gonic/gin"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/util/cache"
+)
+
+const (
+	MAX_CACHED_RESPONSES      = 4096
+	MAX_CACHED_RESPONSE_BYTES = 1 << 20 // 过大的响应(如大列表)不缓存
+)
+
+// 缓存的上游响应
+type cachedResponse struct {
+	code   int
+	header http.Header
+	body   []byte
+}
+
+// 记录ReverseProxy写出的响应
+type responseRecorder struct {
+	cachedResponse
+	buf bytes.Buffer
+}
+
+func (r *responseRecorder) Header() http.Header { return r.header }
+
+func (r *responseRecorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.buf.Write(data)
+}
+
+func (r *responseRecorder) Flush() {}
+
+// 转发GET请求的短时缓存，相同的并发请求只向上游发起一次，
+// 以路径、参数、Accept、Accept-Encoding及调用者身份为key，不同身份之间不共享结果
+type ResponseCache struct {
+	ttl       time.Duration
+	responses *cache.LRUExpireCache
+	group     singleflight.Group
+}
+
+func NewResponseCache(ttl time.Duration) *ResponseCache {
+	return &ResponseCache{ttl: ttl, responses: cache.NewLRUExpireCache(MAX_CACHED_RESPONSES)}
+}
+
+// 是否可以缓存：watch、logs -f等流式请求不缓存
+func cacheableRequest(req *http.Request) bool {
+	if req.Method != http.MethodGet || isUpgradeRequest(req) {
+		return false
+	}
+	query := req.URL.Query()
+	for _, key := range []string{"watch", "follow"} {
+		if val := query.Get(key); val == "1" || val == "true" {
+			return false
+		}
+	}
+	return !strings.Contains(req.URL.Path, "/watch/")
+}
+
+func responseCacheKey(req *http.Request, user *authenticationv1.UserInfo) string {
+	// Extra中有pod-name、credential-id等每个凭证不同的信息，授权不依赖它们，同一身份的调用者共享缓存
+	identity, _ := json.Marshal([]any{user.Username, user.UID, user.Groups})
+	// 调用者要求gzip时上游的响应保持压缩，不能返回给没有要求的调用者
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\n%v?%v\n%v\n%v", identity, req.URL.Path, req.URL.RawQuery, req.Header.Get("Accept"), req.Header.Get("Accept-Encoding"))))
+	return fmt.Sprintf("%x", sum)
+}
+
+// 从缓存返回响应，没有则通过serve向上游请求
+func (c *ResponseCache) ServeHTTP(ctx *gin.Context, user *authenticationv1.UserInfo, serve http.Handler) {
+	key := responseCacheKey(ctx.Request, user)
+	val, ok := c.responses.Get(key)
+	if !ok {
+		val, _, _ = c.group.Do(key, func() (any, error) {
+			rec := &responseRecorder{cachedResponse: cachedResponse{header: make(http.Header)}}
+			// 共享的上游请求不随发起者断开而取消
+			serve.ServeHTTP(rec, ctx.Request.Clone(context.WithoutCancel(ctx.Request.Context())))
+			rec.body = rec.buf.Bytes()
+			resp := &rec.cachedResponse
+			if resp.code < http.StatusInternalServerError && len(resp.body) <= MAX_CACHED_RESPONSE_BYTES {
+				c.responses.Add(key, resp, c.ttl)
+			}
+			return resp, nil
+		})
+	}
+
+	resp, ok := val.(*cachedResponse)
+	if !ok { // 共享的上游请求异常中断(如ReverseProxy的http.ErrAbortHandler)，单独转发
+		serve.ServeHTTP(ctx.Writer, ctx.Request)
+		return
+	}
+	for key, values := range resp.header {
+		ctx.Writer.Header()[key] = values
+	}
+	ctx.Writer.WriteHeader(resp.code)
+	ctx.Writer.Write(resp.body)
+}
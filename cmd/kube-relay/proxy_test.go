@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// 本地的假上游：exec协议升级后回显收到的数据，logs?follow=true分块输出
+func newFakeUpstream(t *testing.T, next chan struct{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Impersonate-User"); got != anonymousUser.Username {
+			t.Errorf("Impersonate-User = %q, want %q", got, anonymousUser.Username)
+		}
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/exec"):
+			if !isUpgradeRequest(r) {
+				t.Errorf("exec request is not an upgrade request")
+				http.Error(w, "upgrade required", http.StatusBadRequest)
+				return
+			}
+			conn, buf, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Errorf("hijack upstream: %v", err)
+				return
+			}
+			defer conn.Close()
+			fmt.Fprintf(buf, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: %v\r\n\r\n", r.Header.Get("Upgrade"))
+			buf.Flush()
+			io.Copy(conn, buf) // 回显
+		case strings.HasSuffix(r.URL.Path, "/log"):
+			if r.URL.Query().Get("follow") != "true" {
+				t.Errorf("log request without follow=true")
+			}
+			w.Header().Set("Content-Type", "text/plain")
+			for i := 1; i <= 2; i++ {
+				fmt.Fprintf(w, "line %d\n", i)
+				w.(http.Flusher).Flush()
+				select {
+				case <-next: // 客户端收到上一行后才继续输出
+				case <-r.Context().Done():
+					return
+				}
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func newTestRelay(t *testing.T, upstream *httptest.Server) *httptest.Server {
+	p, err := NewUpstreamProxy(&rest.Config{Host: upstream.URL}, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.NoRoute(p.ProxyFunc)
+	return httptest.NewServer(engine)
+}
+
+func TestProxyUpgrade(t *testing.T) {
+	upstream := newFakeUpstream(t, nil)
+	defer upstream.Close()
+	relay := newTestRelay(t, upstream)
+	defer relay.Close()
+
+	conn, err := net.Dial("tcp", relay.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "POST /api/v1/namespaces/default/pods/p/exec?command=cat HTTP/1.1\r\nHost: relay\r\n"+
+		"Connection: Upgrade\r\nUpgrade: SPDY/3.1\r\nX-Stream-Protocol-Version: v4.channel.k8s.io\r\n\r\n")
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != "SPDY/3.1" {
+		t.Fatalf("response = %v, Upgrade: %q, want 101 SPDY/3.1", resp.Status, resp.Header.Get("Upgrade"))
+	}
+
+	// 升级后的连接双向转发
+	for _, msg := range []string{"ping\n", "pong\n"} {
+		if _, err := io.WriteString(conn, msg); err != nil {
+			t.Fatal(err)
+		}
+		got, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != msg {
+			t.Errorf("echo = %q, want %q", got, msg)
+		}
+	}
+}
+
+func TestProxyLogFollow(t *testing.T) {
+	next := make(chan struct{})
+	upstream := newFakeUpstream(t, next)
+	defer upstream.Close()
+	relay := newTestRelay(t, upstream)
+	defer relay.Close()
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(relay.URL + "/api/v1/namespaces/default/pods/p/log?follow=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("response = %v, want 200", resp.Status)
+	}
+
+	// 上游在客户端读到前一行之前不会输出下一行，每次写入都需要立即刷新
+	reader := bufio.NewReader(resp.Body)
+	for i := 1; i <= 2; i++ {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("line %d\n", i); line != want {
+			t.Errorf("line = %q, want %q", line, want)
+		}
+		next <- struct{}{}
+	}
+	if _, err := reader.ReadString('\n'); err != io.EOF {
+		t.Errorf("after the last line: %v, want EOF", err)
+	}
+}
+
+// 开启--proxy时，缓存提供的资源同样以调用者的权限访问
+func TestCacheAuthorization(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		review := &authorizationv1.SubjectAccessReview{}
+		if r.URL.Path != "/apis/authorization.k8s.io/v1/subjectaccessreviews" || json.NewDecoder(r.Body).Decode(review) != nil {
+			http.NotFound(w, r)
+			return
+		}
+		attrs := review.Spec.ResourceAttributes
+		review.Status.Allowed = review.Spec.User == anonymousUser.Username && attrs.Namespace == "allowed" && attrs.Verb == "list"
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(review)
+	}))
+	defer upstream.Close()
+
+	config := &rest.Config{Host: upstream.URL}
+	p, err := NewUpstreamProxy(config, kubernetes.NewForConfigOrDie(config), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := NewApp()
+	app.proxy = p
+	gin.SetMode(gin.TestMode)
+	app.Engine = gin.New()
+	res := NewResourceHandler(schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}, nil)
+	res.apiRes = metav1.APIResource{Name: "configmaps", Namespaced: true, Kind: "ConfigMap"}
+	app.resMap[res.GVR] = res
+	app.SetWatchFunc(res)
+	relay := httptest.NewServer(app.Engine)
+	defer relay.Close()
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{path: "/api/v1/namespaces/allowed/configmaps", want: http.StatusServiceUnavailable}, // 通过鉴权，缓存还未同步
+		{path: "/api/v1/namespaces/denied/configmaps", want: http.StatusForbidden},
+		{path: "/api/v1/namespaces/allowed/configmaps?watch=true", want: http.StatusForbidden},
+		{path: "/api/v1/watch/namespaces/allowed/configmaps", want: http.StatusForbidden},
+		{path: "/api/v1/configmaps", want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		resp, err := http.Get(relay.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("GET %v = %v, want %v", tt.path, resp.StatusCode, tt.want)
+		}
+	}
+}
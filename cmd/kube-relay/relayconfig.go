@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/anhk/kube-relay/pkg/log"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/yaml"
+)
+
+const RELAY_CONFIG_APPLIED = "Applied" // status中的condition类型
+
+var relayConfigGVR = schema.GroupVersionResource{Group: "kube-relay.anhk.io", Version: "v1alpha1", Resource: "relayconfigs"}
+
+// RelayConfig对象的status
+type RelayConfigStatus struct {
+	ObservedGeneration int64                   `json:"observedGeneration,omitempty"`
+	Resources          []RelayedResourceStatus `json:"resources,omitempty"` // 生效的资源配置
+	Conditions         []metav1.Condition      `json:"conditions,omitempty"`
+}
+
+type RelayedResourceStatus struct {
+	Name          string           `json:"name"`      // <resource>[.<group>]/<version>
+	MatchedBy     string           `json:"matchedBy"` // 匹配到的配置名称
+	FIFOSize      int              `json:"fifoSize"`
+	ResyncPeriod  metav1.Duration  `json:"resyncPeriod"`
+	Namespaces    []string         `json:"namespaces,omitempty"`
+	LabelSelector string           `json:"labelSelector,omitempty"`
+	FieldSelector string           `json:"fieldSelector,omitempty"`
+	Transforms    *TransformConfig `json:"transforms,omitempty"`
+}
+
+// 解析--config-object，<namespace>/<name>，未指定namespace时为default
+func splitConfigObject(key string) (string, string, error) {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil || name == "" {
+		return "", "", fmt.Errorf("invalid --config-object %q, expected <namespace>/<name>", key)
+	}
+	if namespace == "" {
+		namespace = metav1.NamespaceDefault
+	}
+	return namespace, name, nil
+}
+
+// 从RelayConfig对象中解析配置，spec的格式与配置文件相同
+func parseConfigObject(obj *unstructured.Unstructured) (*RelayConfig, error) {
+	conf := &RelayConfig{TypeMeta: metav1.TypeMeta{APIVersion: obj.GetAPIVersion(), Kind: obj.GetKind()}}
+	data, err := json.Marshal(obj.Object["spec"])
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.UnmarshalStrict(data, &conf.RelayConfigSpec); err != nil {
+		return nil, fmt.Errorf("parse spec: %v", err)
+	}
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// 读取RelayConfig对象，不存在时返回NotFound
+func LoadConfigObject(client dynamic.Interface, namespace, name string) (*RelayConfig, error) {
+	obj, err := client.Resource(relayConfigGVR).Namespace(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	conf, err := parseConfigObject(obj)
+	if err != nil {
+		return nil, fmt.Errorf("RelayConfig %v/%v: %v", namespace, name, err)
+	}
+	return conf, nil
+}
+
+// 跟随集群中的RelayConfig对象热加载资源，结果写回对象的status；
+// 全局配置中只有logLevel即时生效，其余在重启后生效
+type ConfigObjectWatcher struct {
+	app       *App
+	client    dynamic.Interface
+	namespace string
+	name      string
+	apply     func(conf *RelayConfig) []ResourceConfig // 与命令行参数合并，返回被中继的资源
+	lister    cache.GenericLister
+	queue     workqueue.RateLimitingInterface // 只有一个key，即对象的名称
+	applied   int64                           // 已处理的generation，热加载失败时不更新，以便重试
+}
+
+func NewConfigObjectWatcher(app *App, client dynamic.Interface, namespace, name string, apply func(*RelayConfig) []ResourceConfig) *ConfigObjectWatcher {
+	return &ConfigObjectWatcher{
+		app:       app,
+		client:    client,
+		namespace: namespace,
+		name:      name,
+		apply:     apply,
+		queue:     workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+	}
+}
+
+func (w *ConfigObjectWatcher) Run() {
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(w.client, RESYNC_PERIOD, w.namespace, func(opts *metav1.ListOptions) {
+		opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", w.name).String()
+	})
+	informer := factory.ForResource(relayConfigGVR)
+	informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj any) { w.queue.Add(w.name) },
+		UpdateFunc: func(oldObj, newObj any) {
+			// 只写status或resync时generation不变
+			if oldObj.(*unstructured.Unstructured).GetGeneration() != newObj.(*unstructured.Unstructured).GetGeneration() {
+				w.queue.Add(w.name)
+			}
+		},
+		DeleteFunc: func(obj any) {
+			log.Warn("RelayConfig %v/%v deleted, keep relaying the current resources", w.namespace, w.name)
+		},
+	})
+	w.lister = informer.Lister()
+	go informer.Informer().Run(wait.NeverStop)
+	go wait.Until(w.worker, time.Second, wait.NeverStop)
+}
+
+func (w *ConfigObjectWatcher) worker() {
+	for {
+		key, quit := w.queue.Get()
+		if quit {
+			return
+		}
+		if err := w.reconcile(); err != nil { // 热加载失败(如上游暂时不可用)时退避重试，无需修改spec
+			log.Warn("apply RelayConfig %v/%v failed, will retry: %v", w.namespace, w.name, err)
+			w.queue.AddRateLimited(key)
+		} else {
+			w.queue.Forget(key)
+		}
+		w.queue.Done(key)
+	}
+}
+
+func (w *ConfigObjectWatcher) reconcile() error {
+	obj, err := w.lister.ByNamespace(w.namespace).Get(w.name)
+	if apierrors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	u := obj.(*unstructured.Unstructured)
+	if u.GetGeneration() == w.applied {
+		return nil
+	}
+	if err := w.sync(u); err != nil {
+		return err
+	}
+	w.applied = u.GetGeneration()
+	return nil
+}
+
+// 应用对象中的配置并更新status，热加载或写status失败时返回错误以便重试；spec无效时只能等待修改
+func (w *ConfigObjectWatcher) sync(obj *unstructured.Unstructured) error {
+	log.Info("RelayConfig %v/%v generation %v changed, reloading resources", w.namespace, w.name, obj.GetGeneration())
+	cond := metav1.Condition{Type: RELAY_CONFIG_APPLIED, Status: metav1.ConditionTrue, Reason: "Applied", ObservedGeneration: obj.GetGeneration()}
+	var reloadErr error
+	conf, err := parseConfigObject(obj)
+	if err != nil {
+		log.Error("RelayConfig %v/%v is invalid, keep relaying the current resources: %v", w.namespace, w.name, err)
+		cond.Status, cond.Reason, cond.Message = metav1.ConditionFalse, "Invalid", err.Error()
+	} else if reloadErr = w.app.Reload(w.apply(conf)); reloadErr != nil {
+		cond.Status, cond.Reason, cond.Message = metav1.ConditionFalse, "ReloadFailed", reloadErr.Error()
+	}
+	if err := w.writeStatus(obj, cond); err != nil {
+		return fmt.Errorf("update status: %v", err)
+	}
+	return reloadErr
+}
+
+func (w *ConfigObjectWatcher) writeStatus(obj *unstructured.Unstructured, cond metav1.Condition) error {
+	status := RelayConfigStatus{ObservedGeneration: obj.GetGeneration()}
+	if conditions, ok, _ := unstructured.NestedSlice(obj.Object, "status", "conditions"); ok {
+		data, _ := json.Marshal(conditions)
+		_ = json.Unmarshal(data, &status.Conditions)
+	}
+	meta.SetStatusCondition(&status.Conditions, cond) // 状态不变时保留lastTransitionTime
+
+	w.app.mu.RLock()
+	for gvr, config := range w.app.static {
+		res := RelayedResourceStatus{
+			Name:         resourceArg(gvr),
+			MatchedBy:    config.Name,
+			FIFOSize:     config.fifoSize(),
+			ResyncPeriod: metav1.Duration{Duration: config.resyncPeriod()},
+		}
+		if len(config.Namespaces) > 0 { // 展开环境变量后的值
+			res.Namespaces = config.upstreamNamespaces()
+		}
+		res.LabelSelector, _ = expandEnv(config.LabelSelector)
+		res.FieldSelector, _ = expandEnv(config.FieldSelector)
+		if !config.Transforms.Empty() {
+			res.Transforms = &config.Transforms
+		}
+		status.Resources = append(status.Resources, res)
+	}
+	w.app.mu.RUnlock()
+	sort.Slice(status.Resources, func(i, j int) bool { return status.Resources[i].Name < status.Resources[j].Name })
+
+	patch, err := json.Marshal(map[string]any{"status": status})
+	if err != nil {
+		return err
+	}
+	_, err = w.client.Resource(relayConfigGVR).Namespace(w.namespace).Patch(context.Background(), w.name, types.MergePatchType, patch, metav1.PatchOptions{}, "status")
+	return err
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// 假的上游：提供configmaps的discovery及list/watch，记录RelayConfig的status patch
+type fakeConfigUpstream struct {
+	*httptest.Server
+	mu      sync.Mutex
+	patches []RelayConfigStatus
+}
+
+func newFakeConfigUpstream(t *testing.T) *fakeConfigUpstream {
+	f := &fakeConfigUpstream{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/api":
+			fmt.Fprint(w, `{"kind":"APIVersions","versions":["v1"]}`)
+		case r.URL.Path == "/apis":
+			fmt.Fprint(w, `{"kind":"APIGroupList","apiVersion":"v1","groups":[]}`)
+		case r.URL.Path == "/api/v1":
+			fmt.Fprint(w, `{"kind":"APIResourceList","groupVersion":"v1","resources":[`+
+				`{"name":"configmaps","singularName":"configmap","namespaced":true,"kind":"ConfigMap","verbs":["get","list","watch"],"shortNames":["cm"]}]}`)
+		case r.URL.Path == "/api/v1/configmaps" && r.URL.Query().Get("watch") == "true":
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		case r.URL.Path == "/api/v1/configmaps":
+			fmt.Fprint(w, `{"kind":"ConfigMapList","apiVersion":"v1","metadata":{"resourceVersion":"5"},"items":[]}`)
+		case r.Method == http.MethodPatch && strings.HasSuffix(r.URL.Path, "/relayconfigs/relay/status"):
+			data, _ := io.ReadAll(r.Body)
+			patch := struct {
+				Status RelayConfigStatus `json:"status"`
+			}{}
+			if err := json.Unmarshal(data, &patch); err != nil {
+				t.Errorf("decode status patch: %v", err)
+			}
+			f.mu.Lock()
+			f.patches = append(f.patches, patch.Status)
+			f.mu.Unlock()
+			fmt.Fprint(w, `{"apiVersion":"kube-relay.anhk.io/v1alpha1","kind":"RelayConfig","metadata":{"name":"relay","namespace":"default"}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"NotFound","code":404}`)
+		}
+	}))
+	return f
+}
+
+func (f *fakeConfigUpstream) lastPatch(t *testing.T) RelayConfigStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.patches) == 0 {
+		t.Fatal("no status patch written")
+	}
+	return f.patches[len(f.patches)-1]
+}
+
+func newTestConfigObjectWatcher(t *testing.T, f *fakeConfigUpstream) *ConfigObjectWatcher {
+	config := &rest.Config{Host: f.URL}
+	app := NewApp()
+	app.kubeClient = kubernetes.NewForConfigOrDie(config)
+	app.dynamicClient = dynamic.NewForConfigOrDie(config)
+	app.crdWatcher = NewCRDWatcher(app, nil, nil)
+	app.proxy = &UpstreamProxy{} // 不刷新OpenAPI
+	t.Cleanup(func() {
+		for gvr := range app.handlers() {
+			app.removeHandler(gvr)
+		}
+	})
+	return NewConfigObjectWatcher(app, app.dynamicClient, "default", "relay", func(conf *RelayConfig) []ResourceConfig {
+		return conf.Resources
+	})
+}
+
+func relayConfigObject(generation int64, spec string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	if err := obj.UnmarshalJSON([]byte(fmt.Sprintf(`{"apiVersion":"kube-relay.anhk.io/v1alpha1","kind":"RelayConfig",`+
+		`"metadata":{"name":"relay","namespace":"default","generation":%d},"spec":%v}`, generation, spec))); err != nil {
+		panic(err)
+	}
+	return obj
+}
+
+func TestConfigObjectWatcherSync(t *testing.T) {
+	f := newFakeConfigUpstream(t)
+	defer f.Close()
+	defer f.CloseClientConnections()
+	w := newTestConfigObjectWatcher(t, f)
+
+	tests := []struct {
+		name       string
+		spec       string
+		wantErr    bool // 需要重试
+		wantStatus metav1.ConditionStatus
+		wantReason string
+		wantNames  []string
+	}{
+		{
+			name:       "valid",
+			spec:       `{"resources":[{"name":"cm","fifoSize":128}]}`,
+			wantStatus: metav1.ConditionTrue,
+			wantReason: "Applied",
+			wantNames:  []string{"configmaps/v1"},
+		},
+		{
+			name:       "invalid",
+			spec:       `{"resources":[{"name":"cm","fifoSize":-1}]}`,
+			wantStatus: metav1.ConditionFalse,
+			wantReason: "Invalid",
+			wantNames:  []string{"configmaps/v1"}, // 保持原有的资源
+		},
+		{
+			name:       "reload failed",
+			spec:       `{"resources":[{"name":"widgets"}]}`,
+			wantErr:    true,
+			wantStatus: metav1.ConditionFalse,
+			wantReason: "ReloadFailed",
+			wantNames:  []string{"configmaps/v1"},
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			generation := int64(i + 1)
+			err := w.sync(relayConfigObject(generation, tt.spec))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("sync() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			status := f.lastPatch(t)
+			if status.ObservedGeneration != generation {
+				t.Errorf("observedGeneration = %v, want %v", status.ObservedGeneration, generation)
+			}
+			if len(status.Conditions) != 1 {
+				t.Fatalf("conditions = %+v, want one", status.Conditions)
+			}
+			cond := status.Conditions[0]
+			if cond.Type != RELAY_CONFIG_APPLIED || cond.Status != tt.wantStatus || cond.Reason != tt.wantReason || cond.ObservedGeneration != generation {
+				t.Errorf("condition = %+v, want %v %v", cond, tt.wantStatus, tt.wantReason)
+			}
+			if tt.wantStatus == metav1.ConditionFalse && cond.Message == "" {
+				t.Errorf("condition message is empty")
+			}
+			var names []string
+			for _, res := range status.Resources {
+				names = append(names, res.Name)
+				if res.MatchedBy != "cm" || res.FIFOSize != 128 {
+					t.Errorf("resource status = %+v, want matched by cm with fifoSize 128", res)
+				}
+			}
+			if fmt.Sprint(names) != fmt.Sprint(tt.wantNames) {
+				t.Errorf("resources = %v, want %v", names, tt.wantNames)
+			}
+		})
+	}
+}
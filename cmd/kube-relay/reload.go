@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/anhk/kube-relay/pkg/log"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	RELOAD_INTERVAL     = 5 * time.Second // 检查配置文件变化的间隔
+	RELOAD_SYNC_TIMEOUT = time.Minute     // 替换资源前等待新informer同步的时间
+)
+
+// 收到SIGHUP或配置文件内容变化时重新加载被中继的资源
+func (app *App) WatchReload(file string, load func() ([]ResourceConfig, error)) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	ticker := time.NewTicker(RELOAD_INTERVAL)
+	defer ticker.Stop()
+
+	digest := fileDigest(file)
+	for {
+		select {
+		case <-sigCh:
+			log.Info("SIGHUP received, reloading resources")
+			digest = fileDigest(file)
+		case <-ticker.C:
+			// 文件暂时不可读时(如ConfigMap正在更新)等待下次检查
+			d := fileDigest(file)
+			if d == "" || d == digest {
+				continue
+			}
+			digest = d
+			log.Info("%v changed, reloading resources", file)
+		}
+
+		configs, err := load()
+		if err == nil {
+			err = app.Reload(configs)
+		}
+		if err != nil {
+			log.Error("reload failed, keep relaying the current resources: %v", err)
+		}
+	}
+}
+
+// 文件内容的摘要，文件未指定或不可读时为空
+func fileDigest(file string) string {
+	if file == "" {
+		return ""
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+// 按新的配置增删被中继的资源：配置未变的资源及其watch不受影响，
+// 新增或配置变化的资源同步后再替换，被移除的资源停止informer并正常结束watch
+func (app *App) Reload(configs []ResourceConfig) error {
+	app.reloadMu.Lock()
+	defer app.reloadMu.Unlock()
+
+	resources, err := resolveResourceConfigs(app.kubeClient.Discovery(), configs)
+	if err != nil {
+		return err
+	}
+	desired := make(map[schema.GroupVersionResource]*ResourceConfig, len(resources))
+	for _, res := range resources {
+		desired[res.GVR] = res.Config
+	}
+
+	// 先启动新的handler，失败时不改变当前状态
+	current := app.handlers()
+	var changed []RelayedResource
+	for _, res := range resources {
+		if resHandler, ok := current[res.GVR]; !ok || !sameSettings(resHandler.config, res.Config) {
+			changed = append(changed, res)
+		}
+	}
+	started, err := app.startHandlers(changed)
+	if err != nil {
+		return err
+	}
+
+	app.mu.Lock()
+	static := app.static
+	app.static = desired
+	app.mu.Unlock()
+
+	for _, resHandler := range started {
+		app.addHandler(resHandler)
+		if old, ok := current[resHandler.GVR]; ok {
+			old.Stop()
+			log.Info("reload %v with new settings", resHandler.GVR)
+		} else {
+			log.Info("start relaying %v", resHandler.GVR)
+		}
+	}
+	for gvr, resHandler := range current {
+		if _, ok := desired[gvr]; ok {
+			continue
+		}
+		if _, ok := static[gvr]; !ok { // 按需启动或跟随CRD加入的资源
+			continue
+		}
+		if app.crdWatcher.matchGroup(gvr.Group) && sameSettings(resHandler.config, nil) { // 仍由--crd-groups中继
+			continue
+		}
+		app.removeHandler(gvr)
+		log.Info("stop relaying %v", gvr)
+	}
+
+	if app.crdWatcher.Needed() {
+		app.crdWatcher.Run()
+	}
+	app.resourcesChanged()
+	return nil
+}
+
+// 创建并启动资源的handler，全部取得资源信息后才启动informer，并等待同步最多RELOAD_SYNC_TIMEOUT，
+// 返回的handler尚未加入resMap
+func (app *App) startHandlers(resources []RelayedResource) ([]*ResourceHandler, error) {
+	var result []*ResourceHandler
+	for _, res := range resources {
+		resHandler := NewResourceHandler(res.GVR, res.Config)
+		if err := resHandler.GetInfoByKubeClient(app.kubeClient); err != nil {
+			return nil, err
+		}
+		result = append(result, resHandler)
+	}
+
+	var listSynced []cache.InformerSynced
+	for _, resHandler := range result {
+		resHandler.LoadTableColumns(app.dynamicClient)
+		listSynced = append(listSynced, resHandler.RunWithDynamicClient(app.dynamicClient))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), RELOAD_SYNC_TIMEOUT)
+	defer cancel()
+	if !cache.WaitForCacheSync(ctx.Done(), listSynced...) {
+		log.Warn("new resources are not synced after %v, serving them anyway", RELOAD_SYNC_TIMEOUT)
+	}
+	return result, nil
+}
@@ -1,31 +1,54 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/anhk/kube-relay/pkg/log"
 	"github.com/gin-gonic/gin"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/dynamic"
-	"k8s.io/client-go/dynamic/dynamicinformer"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
 )
 
+const (
+	BOOKMARK_INTERVAL             = time.Minute
+	INITIAL_EVENTS_END_ANNOTATION = "k8s.io/initial-events-end"
+	LEGACY_WATCH_KEY              = "legacyWatch" // 通过/watch/前缀访问，等同于watch=true
+	RESYNC_PERIOD                 = 30 * time.Minute
+	SYNC_VERSION_INTERVAL         = time.Second // 以informer的同步进度推进缓存版本的间隔
+)
+
 type ResourceHandler struct {
 	GVR    schema.GroupVersionResource
 	Lister cache.GenericLister
 	apiRes metav1.APIResource
-	apiGr  metav1.APIGroup
+	config *ResourceConfig // 配置文件中匹配的配置，可以为nil
+
+	fifo    *ResourceFifo
+	pager   *ListPager
+	synced  cache.InformerSynced
+	columns []TableColumn // Table输出的列
+
+	subResources []metav1.APIResource
 
-	fifo *ResourceFifo
+	lazy     bool          // 由客户端请求按需启动，空闲后停止
+	stopCh   chan struct{} // 关闭后停止informer及正在进行的watch
+	stopOnce sync.Once
+	watchMu  sync.Mutex
+	watchers map[uint64]*Watcher // 正在进行的watch
+	lastUsed int64               // 最近一次请求开始或结束的时间(UnixNano)
 }
 
 type ListWrapper struct {
@@ -34,129 +57,441 @@ type ListWrapper struct {
 	Items           []runtime.Object `json:"items"`
 }
 
+func (lw *ListWrapper) DeepCopyObject() runtime.Object {
+	out := &ListWrapper{TypeMeta: lw.TypeMeta}
+	lw.Metadata.DeepCopyInto(&out.Metadata)
+	out.Items = make([]runtime.Object, 0, len(lw.Items))
+	for _, item := range lw.Items {
+		out.Items = append(out.Items, item.DeepCopyObject())
+	}
+	return out
+}
+
 func (res *ResourceHandler) ListFunc(ctx *gin.Context) {
+	defer res.touch() // 大列表的序列化可能很久，以结束时间计算空闲
 	namespace := ctx.Param("namespace")
 	name := ctx.Param("name")
 	log.Debug("HTTP: [%v] %v/%v", res.GVR, namespace, name)
 
-	version := res.fifo.Version()
-	list, err := res.Lister.List(labels.Everything())
+	if name != "" {
+		res.GetFunc(ctx)
+		return
+	}
+
+	filter, err := NewResourceFilter(ctx)
 	if err != nil {
-		ctx.AbortWithError(502, err)
+		abortWithStatus(ctx, err)
 		return
 	}
 
+	limit, err := strconv.ParseInt(ctx.DefaultQuery("limit", "0"), 10, 64)
+	if err != nil || limit < 0 {
+		abortWithStatus(ctx, apierrors.NewBadRequest("invalid limit"))
+		return
+	}
+
+	var snapshot *ListSnapshot
+	var snapshotID string
+	var offset int
+	if token := ctx.Query("continue"); token != "" {
+		if snapshot, snapshotID, offset, err = res.pager.Continue(token, filter.Scope()); err != nil {
+			abortWithStatus(ctx, err)
+			return
+		}
+	} else {
+		if err := res.checkResourceVersion(ctx.Query("resourceVersion"), ctx.Query("resourceVersionMatch")); err != nil {
+			abortWithStatus(ctx, err)
+			return
+		}
+		snapshot = &ListSnapshot{version: res.fifo.Version(), scope: filter.Scope()} // 事件回调晚于informer缓存的更新，先取版本再取列表，列表不会比版本旧
+		if snapshot.items, err = res.list(filter); err != nil {
+			abortWithStatus(ctx, err)
+			return
+		}
+		sortObjects(snapshot.items)
+	}
+
 	lw := &ListWrapper{}
-	lw.APIVersion = res.GVR.Version
+	lw.APIVersion = res.groupVersion()
 	lw.Kind = fmt.Sprintf("%vList", res.apiRes.Kind)
-	lw.Items = list
-	lw.Metadata.ResourceVersion = version
+	lw.Metadata.ResourceVersion = snapshot.version
+
+	var remaining int64
+	lw.Items, lw.Metadata.Continue, remaining = res.pager.Page(snapshot, snapshotID, offset, limit)
+	if lw.Metadata.Continue != "" {
+		lw.Metadata.RemainingItemCount = &remaining
+	}
+
+	res.negotiateCodec(ctx).WriteObject(ctx, 200, lw)
+}
+
+// 按resourceVersionMatch的语义检查缓存是否满足请求的resourceVersion：
+// 未指定或NotOlderThan时缓存落后则等待，Exact只能是缓存的当前版本
+func (res *ResourceHandler) checkResourceVersion(resourceVersion, match string) error {
+	switch metav1.ResourceVersionMatch(match) {
+	case "":
+	case metav1.ResourceVersionMatchNotOlderThan, metav1.ResourceVersionMatchExact:
+		if resourceVersion == "" {
+			return apierrors.NewBadRequest("resourceVersionMatch is forbidden unless resourceVersion is provided")
+		}
+	default:
+		return apierrors.NewBadRequest(fmt.Sprintf("unsupported resourceVersionMatch: %v", match))
+	}
+	if resourceVersion == "" || resourceVersion == "0" { // 任意版本
+		if match == string(metav1.ResourceVersionMatchExact) {
+			return apierrors.NewBadRequest("resourceVersionMatch=Exact is forbidden for resourceVersion 0")
+		}
+		return nil
+	}
 
-	ctx.JSON(200, lw)
+	rv, err := parseResourceVersion(resourceVersion)
+	if err != nil {
+		return err
+	}
+	if err := res.fifo.WaitFor(rv, RESOURCE_VERSION_WAIT); err != nil {
+		return err
+	}
+	if cur := res.fifo.Version(); match == string(metav1.ResourceVersionMatchExact) && cur != resourceVersion {
+		return apierrors.NewResourceExpired(fmt.Sprintf("too old resource version: %v (%v)", resourceVersion, cur))
+	}
+	return nil
+}
+
+// 获取单个对象
+func (res *ResourceHandler) GetFunc(ctx *gin.Context) {
+	if err := res.checkResourceVersion(ctx.Query("resourceVersion"), ""); err != nil {
+		abortWithStatus(ctx, err)
+		return
+	}
+	obj, err := res.get(ctx.Param("namespace"), ctx.Param("name"))
+	if err != nil {
+		abortWithStatus(ctx, err)
+		return
+	}
+	res.negotiateCodec(ctx).WriteObject(ctx, 200, obj)
+}
+
+// 列出符合过滤条件的对象，namespace为空则列出全部
+func (res *ResourceHandler) list(filter *ResourceFilter) ([]runtime.Object, error) {
+	var list []runtime.Object
+	var err error
+	if filter.Namespace == "" {
+		list, err = res.Lister.List(filter.Label)
+	} else {
+		list, err = res.Lister.ByNamespace(filter.Namespace).List(filter.Label)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]runtime.Object, 0, len(list))
+	for _, obj := range list {
+		if filter.Match(obj) {
+			result = append(result, obj)
+		}
+	}
+	return result, nil
+}
+
+func (res *ResourceHandler) get(namespace, name string) (runtime.Object, error) {
+	if namespace == "" {
+		return res.Lister.Get(name)
+	}
+	return res.Lister.ByNamespace(namespace).Get(name)
 }
 
 func (res *ResourceHandler) WatchFunc(ctx *gin.Context) {
-	ctx.Header("content-type", "application/json")
+	res.touch()
+	if res.Stopped() { // 资源已被移除，如CRD被删除
+		notFound(ctx)
+		return
+	}
+	if res.synced == nil || !res.synced() {
+		abortWithStatus(ctx, serviceUnavailable(fmt.Sprintf("%v is not synced yet", res.GVR.GroupResource()), 1))
+		return
+	}
 
 	watch := ctx.Query("watch")
+	if ctx.GetBool(LEGACY_WATCH_KEY) {
+		watch = "true"
+	}
 
 	if watch != "1" && watch != "true" {
 		res.ListFunc(ctx)
 		return
 	}
+	filter, err := NewResourceFilter(ctx)
+	if err != nil {
+		abortWithStatus(ctx, err)
+		return
+	}
 	resourceVersion := ctx.Query("resourceVersion")
-	log.Debug("watch: %v, resourceVersion: %v", watch, resourceVersion)
-	// TODO: resourceVersion如果不存在，返回410 Gone
+	allowBookmarks := ctx.Query("allowWatchBookmarks") == "true"
+	log.Debug("watch: %v, resourceVersion: %v, filter: %+v", watch, resourceVersion, filter)
+	if resourceVersion != "" && resourceVersion != "0" { // 缓存落后于请求的版本时等待其追上
+		rv, err := parseResourceVersion(resourceVersion)
+		if err == nil {
+			err = res.fifo.WaitFor(rv, RESOURCE_VERSION_WAIT)
+		}
+		if err != nil {
+			abortWithStatus(ctx, err)
+			return
+		}
+	}
 
-	if resourceVersion == "" || resourceVersion == "0" { // 拿全部数据
+	// sendInitialEvents未设置时，resourceVersion为空或0则默认发送全部数据
+	sendInitialEvents := resourceVersion == "" || resourceVersion == "0"
+	watchList := false
+	if v := ctx.Query("sendInitialEvents"); v != "" {
+		if sendInitialEvents, err = strconv.ParseBool(v); err != nil {
+			abortWithStatus(ctx, apierrors.NewBadRequest("invalid sendInitialEvents"))
+			return
+		}
+		if sendInitialEvents && (!allowBookmarks || ctx.Query("resourceVersionMatch") != string(metav1.ResourceVersionMatchNotOlderThan)) {
+			abortWithStatus(ctx, apierrors.NewBadRequest("sendInitialEvents requires allowWatchBookmarks=true and resourceVersionMatch=NotOlderThan"))
+			return
+		}
+		watchList = sendInitialEvents
+	}
+
+	codec := res.negotiateCodec(ctx)
+	ctx.Header("content-type", codec.StreamContentType())
+
+	if sendInitialEvents { // 拿全部数据
 		resourceVersion = res.fifo.Version()
-		list, err := res.Lister.List(labels.Everything())
+		list, err := res.list(filter)
 		if err != nil {
-			ctx.AbortWithError(502, err)
+			abortWithStatus(ctx, err)
 			return
 		}
 		for _, obj := range list {
-			event := metav1.WatchEvent{Type: "ADDED", Object: runtime.RawExtension{Object: obj}}
-			data, _ := json.Marshal(event)
-			ctx.Writer.Write(data)
+			codec.WriteEvent(ctx, &metav1.WatchEvent{Type: "ADDED", Object: runtime.RawExtension{Object: obj}})
+		}
+		if watchList { // 以带有initial-events-end注解的BOOKMARK标记初始数据结束
+			event := res.bookmarkEvent(resourceVersion)
+			event.Object.Object.(*unstructured.Unstructured).SetAnnotations(map[string]string{INITIAL_EVENTS_END_ANNOTATION: "true"})
+			codec.WriteEvent(ctx, event)
 		}
 		ctx.Writer.Flush()
+	} else if resourceVersion == "" || resourceVersion == "0" {
+		resourceVersion = res.fifo.Version()
 	}
 
+	lastBookmark := time.Now()
+	watcher := res.addWatcher(ctx)
+	defer res.removeWatcher(watcher)
+
+	seq := int64(-1) // 首次按resourceVersion定位，之后按入队顺序读取
 	ctx.Stream(func(w io.Writer) bool {
 		for {
-			if err := res.fifo.Wait(resourceVersion); err != nil {
-				ctx.AbortWithError(502, err)
+			if res.Stopped() || watcher.Stopped() {
 				return false
 			}
-			list, curVersion, err := res.fifo.Get(resourceVersion)
+			if allowBookmarks && time.Since(lastBookmark) >= BOOKMARK_INTERVAL {
+				codec.WriteEvent(ctx, res.bookmarkEvent(resourceVersion))
+				ctx.Writer.Flush()
+				lastBookmark = time.Now()
+			}
+			var list []*Item
+			var err error
+			if seq < 0 {
+				list, seq, err = res.fifo.Get(resourceVersion)
+			} else {
+				res.fifo.Wait(seq)
+				list, seq, err = res.fifo.Next(seq)
+			}
 			if err != nil {
-				ctx.AbortWithError(410, err)
+				writeErrorEvent(ctx, codec, err)
 				return false
 			}
 			if len(list) == 0 { // avoid CLOSE_WAIT
 				return true
 			}
-			for _, obj := range list {
-				data, _ := json.Marshal(obj)
-				ctx.Writer.Write(data)
+			for _, it := range list {
+				event := filter.FilterEvent(it)
+				if event == nil {
+					continue
+				}
+				codec.WriteEvent(ctx, event)
 			}
 			ctx.Writer.Flush()
-			resourceVersion = curVersion
+			resourceVersion = fmt.Sprintf("%d", list[len(list)-1].key)
 		}
 	})
 }
 
-func (res *ResourceHandler) AddFunc(obj any) {
+// 生成BOOKMARK事件，对象只包含类型及resourceVersion
+func (res *ResourceHandler) bookmarkEvent(resourceVersion string) *metav1.WatchEvent {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion(res.groupVersion())
+	obj.SetKind(res.apiRes.Kind)
+	obj.SetResourceVersion(resourceVersion)
+	return &metav1.WatchEvent{Type: "BOOKMARK", Object: runtime.RawExtension{Object: obj}}
+}
+
+func (res *ResourceHandler) groupVersion() string {
+	return res.GVR.GroupVersion().String()
+}
+
+func (res *ResourceHandler) GVK() schema.GroupVersionKind {
+	return res.GVR.GroupVersion().WithKind(res.apiRes.Kind)
+}
+
+func (res *ResourceHandler) AddFunc(obj any, isInInitialList bool) {
+	if isInInitialList { // 初始列表不产生事件，watch从列表的resourceVersion之后开始
+		return
+	}
 	event := metav1.WatchEvent{Type: "ADDED", Object: runtime.RawExtension{Object: obj.(runtime.Object)}}
-	res.fifo.Push(&event)
+	res.fifo.Push(&event, nil)
 }
 
 func (res *ResourceHandler) UpdateFunc(oldObj, newObj any) {
+	if resourceVersionOf(oldObj.(runtime.Object)) == resourceVersionOf(newObj.(runtime.Object)) { // 定期resync，没有变化
+		return
+	}
 	event := metav1.WatchEvent{Type: "MODIFIED", Object: runtime.RawExtension{Object: newObj.(runtime.Object)}}
-	res.fifo.Push(&event)
+	res.fifo.Push(&event, oldObj.(runtime.Object))
 }
 
 func (res *ResourceHandler) DeleteFunc(obj any) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok { // 重新List时才发现的删除
+		obj = tombstone.Obj
+	}
 	event := metav1.WatchEvent{Type: "DELETED", Object: runtime.RawExtension{Object: obj.(runtime.Object)}}
-	res.fifo.Push(&event)
+	res.fifo.Push(&event, nil)
 }
 
 func (res *ResourceHandler) GetInfoByKubeClient(kubeClient *kubernetes.Clientset) error {
-	var groupVersion = "v1" // CoreAPI
-	if res.GVR.Group != "" {
-		groupVersion = fmt.Sprintf("%v/%v", res.GVR.Group, res.GVR.Version)
-	}
+	var groupVersion = res.groupVersion() // CoreAPI为v1
 
 	resourceList, err := kubeClient.DiscoveryClient.ServerResourcesForGroupVersion(groupVersion)
 	if err != nil {
 		return err
 	}
+	found := false
+	res.subResources = nil
 	for _, v := range resourceList.APIResources {
 		if v.Name == res.GVR.Resource {
 			res.apiRes = v
-			res.apiGr.Name = res.GVR.Group
-			res.apiGr.Versions = []metav1.GroupVersionForDiscovery{{GroupVersion: groupVersion, Version: res.GVR.Version}}
-			res.apiGr.PreferredVersion = res.apiGr.Versions[0]
-			return nil
+			found = true
+		} else if strings.HasPrefix(v.Name, res.GVR.Resource+"/") { // 子资源，如services/status
+			res.subResources = append(res.subResources, v)
 		}
 	}
+	if !found {
+		return fmt.Errorf("%v not found", res.GVR)
+	}
+	return nil
+}
 
-	return fmt.Errorf("%v not found", res.GVR)
+// 记录最近一次使用的时间
+func (res *ResourceHandler) touch() {
+	atomic.StoreInt64(&res.lastUsed, time.Now().UnixNano())
 }
 
-func (res *ResourceHandler) RunWithDynamicClient(dynamicClient dynamic.Interface) cache.InformerSynced {
-	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(dynamicClient, 30*time.Minute, "", nil)
-	informer := factory.ForResource(res.GVR)
-	informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc: res.AddFunc, UpdateFunc: res.UpdateFunc, DeleteFunc: res.DeleteFunc,
+// 空闲时长，有watch时为0，否则从最近一次请求结束算起
+func (res *ResourceHandler) Idle() time.Duration {
+	if res.watcherCount() > 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, atomic.LoadInt64(&res.lastUsed)))
+}
+
+// 停止informer，正在进行的watch随之正常结束
+func (res *ResourceHandler) Stop() {
+	res.stopOnce.Do(func() {
+		close(res.stopCh)
+		res.fifo.cond.Broadcast() // 唤醒等待事件的watch
 	})
-	go informer.Informer().Run(wait.NeverStop)
-	res.Lister = informer.Lister()
-	return informer.Informer().HasSynced
 }
 
-func NewResourceHandler(gvr schema.GroupVersionResource) *ResourceHandler {
+func (res *ResourceHandler) Stopped() bool {
+	select {
+	case <-res.stopCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// 启动informer，直到Stop；配置了namespaces时每个namespace一个informer，事件汇入同一个FIFO
+func (res *ResourceHandler) RunWithDynamicClient(dynamicClient dynamic.Interface) cache.InformerSynced {
+	namespaces := []string{metav1.NamespaceAll}
+	if res.apiRes.Namespaced {
+		namespaces = res.config.upstreamNamespaces()
+	} else if res.config != nil && len(res.config.Namespaces) > 0 {
+		log.Warn("%v is cluster-scoped, namespaces in its config are ignored", res.GVR)
+	}
+
+	lister := &namespacedLister{resource: res.GVR.GroupResource(), listers: make(map[string]cache.GenericLister)}
+	var informers []*trackedInformer
+	var registrations []cache.InformerSynced
+	for _, namespace := range namespaces {
+		informer := newTrackedInformer(dynamicClient, res.GVR, namespace, res.config)
+		informer.source = res.fifo.AddSource()
+		if transform := res.config.transform(); transform != nil {
+			_ = informer.SetTransform(transform) // 只在informer启动后失败
+		}
+		registration, _ := informer.AddEventHandler(cache.ResourceEventHandlerDetailedFuncs{
+			AddFunc: func(obj any, isInInitialList bool) {
+				res.AddFunc(obj, isInInitialList)
+				res.deliver(informer, obj)
+			},
+			UpdateFunc: func(oldObj, newObj any) {
+				res.UpdateFunc(oldObj, newObj)
+				res.deliver(informer, newObj)
+			},
+			DeleteFunc: func(obj any) {
+				res.DeleteFunc(obj)
+				if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+					obj = tombstone.Obj
+				}
+				res.deliver(informer, obj)
+			},
+		})
+		informers = append(informers, informer)
+		registrations = append(registrations, registration.HasSynced)
+		lister.listers[namespace] = informer.Lister(res.GVR)
+		res.Lister = informer.Lister(res.GVR)
+	}
+	if len(namespaces) > 1 || namespaces[0] != metav1.NamespaceAll {
+		res.Lister = lister
+	}
+
+	for _, informer := range informers {
+		go informer.Run(res.stopCh)
+	}
+	go func() { // 回调处理完初始列表后才能提供watch
+		if !cache.WaitForCacheSync(res.stopCh, registrations...) {
+			return
+		}
+		res.syncVersion(informers) // 以列表的resourceVersion为起点，而不是列表中最新的对象
+		res.fifo.Start()
+		wait.Until(func() { res.syncVersion(informers) }, SYNC_VERSION_INTERVAL, res.stopCh)
+	}()
+	res.synced = res.fifo.Started
+	return res.synced
+}
+
+// 事件已经送达FIFO，informer没有其它未送达的事件时推进它的版本
+func (res *ResourceHandler) deliver(informer *trackedInformer, obj any) {
+	informer.deliver(obj.(runtime.Object))
+	if rv, ok := informer.SyncedVersion(); ok {
+		res.fifo.Advance(informer.source, rv)
+	}
+}
+
+// 以informer的同步进度推进缓存的版本：上游最后的事件是删除或者只有BOOKMARK时，
+// 列表中对象的resourceVersion都比上游旧，客户端使用上游的版本会一直等待
+func (res *ResourceHandler) syncVersion(informers []*trackedInformer) {
+	for _, informer := range informers {
+		if rv, ok := informer.SyncedVersion(); ok {
+			res.fifo.Advance(informer.source, rv)
+		}
+	}
+}
+
+func NewResourceHandler(gvr schema.GroupVersionResource, config *ResourceConfig) *ResourceHandler {
 	log.Info("resource=%v, group=%v, version=%v", gvr.Resource, gvr.Group, gvr.Version)
-	return &ResourceHandler{GVR: gvr, fifo: NewResourceFifo()}
+	return &ResourceHandler{GVR: gvr, config: config, fifo: NewResourceFifo(config.fifoSize()), pager: NewListPager(), stopCh: make(chan struct{}), watchers: make(map[uint64]*Watcher), lastUsed: time.Now().UnixNano()}
 }
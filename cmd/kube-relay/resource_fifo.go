@@ -3,105 +3,237 @@ package main
 import (
 	"container/list"
 	"fmt"
+	"slices"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
 
 	"github.com/anhk/kube-relay/pkg/cond"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 )
 
-const MAX_RESOURCE_FIFO_LEN = 0x10000
+const (
+	MAX_RESOURCE_FIFO_LEN = 0x10000
+	RESOURCE_VERSION_WAIT = 3 * time.Second // 请求的resourceVersion比缓存新时最多等待的时间，与apiserver一致
+)
 
 type Item struct {
-	key   string
-	ele   *list.Element
-	event *metav1.WatchEvent
+	key    int64 // 上游的resourceVersion
+	seq    int64 // 提交的序号，resourceVersion相同的事件以此区分
+	ele    *list.Element
+	event  *metav1.WatchEvent
+	oldObj runtime.Object // MODIFIED事件中修改前的对象
 }
 
-// FIFO for Resource
+// FIFO for Resource，以上游对象的resourceVersion为序，
+// 不同的relay实例以及apiserver之间的resourceVersion可以互相使用。
+// 每个informer(source)各自送达事件，只有全部informer都已送达的事件才会提交给watch，
+// 某个namespace的事件晚到时，已经读到更新版本的客户端不会错过它
 type ResourceFifo struct {
-	version int64
-
-	mu    sync.RWMutex     // 读写锁
-	items map[string]*Item // key: version.toString()
-	list  list.List        // LRU列表
+	mu      sync.RWMutex // 读写锁
+	version int64        // 全部informer都已送达的resourceVersion，即sources中最小的，informer的缓存不会比它旧
+	sources []int64      // 每个informer已送达的resourceVersion
+	oldest  int64        // 可以提供的最早resourceVersion，更早的返回`410 Gone`
+	started bool         // 初始列表是否已处理完
+	list    list.List    // 已提交的事件，按resourceVersion排列
+	pending []*Item      // 比version新的事件，按resourceVersion排列，等待其它informer追上
+	size    int          // 保留的事件数
+	seq     int64        // 最后提交的序号
 
 	cond *cond.Cond
 }
 
-func NewResourceFifo() *ResourceFifo {
-	rf := &ResourceFifo{version: 1, items: make(map[string]*Item)}
+func NewResourceFifo(size int) *ResourceFifo {
+	rf := &ResourceFifo{size: size}
 	rf.cond = cond.NewCond(&rf.mu)
 	return rf
 }
 
-func (fifo *ResourceFifo) Push(event *metav1.WatchEvent) {
+// 增加一个informer，在Start之前调用
+func (fifo *ResourceFifo) AddSource() int {
 	fifo.mu.Lock()
 	defer fifo.mu.Unlock()
+	fifo.sources = append(fifo.sources, 0)
+	return len(fifo.sources) - 1
+}
 
-	it := &Item{event: event, key: fmt.Sprintf("%d", fifo.version)}
-	it.ele = fifo.list.PushBack(it)
-	fifo.items[it.key] = it
-	fifo.version++
+// informer已送达resourceVersion及之前的全部事件，推进它的版本并提交其它informer都已送达的事件
+func (fifo *ResourceFifo) Advance(source int, rv int64) {
+	fifo.mu.Lock()
+	defer fifo.mu.Unlock()
+	if rv > fifo.sources[source] {
+		fifo.sources[source] = rv
+		fifo.commit()
+	}
+}
 
-	for fifo.list.Len() > MAX_RESOURCE_FIFO_LEN {
-		fifo.removeOldest()
+// 初始列表处理完成，此后的事件都会被保存，早于此时的resourceVersion无法提供
+func (fifo *ResourceFifo) Start() {
+	fifo.mu.Lock()
+	defer fifo.mu.Unlock()
+	fifo.oldest = fifo.version
+	fifo.started = true
+	fifo.cond.Broadcast()
+}
+
+func (fifo *ResourceFifo) Started() bool {
+	fifo.mu.RLock()
+	defer fifo.mu.RUnlock()
+	return fifo.started
+}
+
+func (fifo *ResourceFifo) Push(event *metav1.WatchEvent, oldObj runtime.Object) {
+	fifo.mu.Lock()
+	defer fifo.mu.Unlock()
+
+	// 重新List时informer合成的事件不保证有序，tombstone也没有resourceVersion，早于已提交版本的沿用当前版本保证单调
+	key, err := parseResourceVersion(resourceVersionOf(event.Object.Object))
+	if err != nil || key < fifo.version {
+		key = fifo.version
+	}
+	it := &Item{event: event, oldObj: oldObj, key: key}
+	i := sort.Search(len(fifo.pending), func(i int) bool { return fifo.pending[i].key > key })
+	fifo.pending = slices.Insert(fifo.pending, i, it)
+	fifo.commit()
+}
+
+// 按resourceVersion提交全部informer都已送达的事件，无锁。
+// 等待的事件超过size时不再等待落后的informer，之后它送达的更早的事件沿用当前版本
+func (fifo *ResourceFifo) commit() {
+	if len(fifo.sources) > 0 && slices.Min(fifo.sources) > fifo.version {
+		fifo.version = slices.Min(fifo.sources)
+	}
+	n := 0
+	for ; n < len(fifo.pending); n++ {
+		it := fifo.pending[n]
+		if it.key > fifo.version {
+			if len(fifo.pending)-n <= fifo.size {
+				break
+			}
+			fifo.version = it.key
+		}
+		fifo.seq++
+		it.seq = fifo.seq
+		it.ele = fifo.list.PushBack(it)
 	}
+	fifo.pending = fifo.pending[n:]
 
+	for fifo.list.Len() > fifo.size {
+		fifo.removeOldest()
+	}
 	fifo.cond.Broadcast()
 }
 
-func (fifo *ResourceFifo) Get(resourceVersion string) ([]*metav1.WatchEvent, string, error) {
+// 返回resourceVersion之后的全部事件，以及之后用于Next的序号
+func (fifo *ResourceFifo) Get(resourceVersion string) ([]*Item, int64, error) {
 	fifo.mu.RLock()
 	defer fifo.mu.RUnlock()
-	curVersion := fmt.Sprintf("%d", fifo.version)
 
-	resVerion, err := strconv.ParseInt(resourceVersion, 10, 64)
+	rv, err := parseResourceVersion(resourceVersion)
 	if err != nil {
-		return nil, curVersion, err
+		return nil, 0, err
+	}
+	if rv < fifo.oldest { // 不存在则返回`410 Gone`
+		return nil, 0, apierrors.NewResourceExpired(fmt.Sprintf("too old resource version: %v (%v)", rv, fifo.oldest))
+	}
+	if rv >= fifo.version { // 没有新事件，或者请求的版本比缓存新
+		return nil, fifo.seq, nil
 	}
 
-	it, ok := fifo.items[resourceVersion]
-	if !ok && resVerion < fifo.version { // 不存在则返回`410 Gone`
-		return nil, curVersion, fmt.Errorf("401 Gone")
-	} else if !ok {
-		return nil, curVersion, nil
+	// 新事件总在队尾，从后向前找到起始位置
+	var start *list.Element
+	for ele := fifo.list.Back(); ele != nil && ele.Value.(*Item).key > rv; ele = ele.Prev() {
+		start = ele
 	}
+	return fifo.itemsFrom(start), fifo.seq, nil
+}
+
+// 返回序号seq之后提交的全部事件，watch开始后按序号读取
+func (fifo *ResourceFifo) Next(seq int64) ([]*Item, int64, error) {
+	fifo.mu.RLock()
+	defer fifo.mu.RUnlock()
 
-	var result []*metav1.WatchEvent
-	for ele := it.ele; ele != nil; ele = ele.Next() {
-		it := ele.Value.(*Item)
-		result = append(result, it.event)
+	if seq >= fifo.seq {
+		return nil, seq, nil
 	}
-	return result, curVersion, nil
+	if front := fifo.list.Front(); front == nil || front.Value.(*Item).seq > seq+1 { // 未读的事件已被移除
+		return nil, seq, apierrors.NewResourceExpired(fmt.Sprintf("too old resource version: watch fell behind by more than %d events", fifo.size))
+	}
+	ele := fifo.list.Back()
+	for ele.Prev() != nil && ele.Prev().Value.(*Item).seq > seq {
+		ele = ele.Prev()
+	}
+	return fifo.itemsFrom(ele), fifo.seq, nil
 }
 
-// 删除最久未使用的一个节点，无锁
+// 从ele到队尾的事件，无锁
+func (fifo *ResourceFifo) itemsFrom(ele *list.Element) []*Item {
+	var result []*Item
+	for ; ele != nil; ele = ele.Next() {
+		result = append(result, ele.Value.(*Item))
+	}
+	return result
+}
+
+// 删除最旧的一个节点，无锁
 func (fifo *ResourceFifo) removeOldest() {
 	keyEle := fifo.list.Front()
 	if keyEle == nil {
 		return
 	}
-	key := fifo.list.Remove(keyEle)
-	delete(fifo.items, key.(string))
-}
-
-// 等待，直到有消息进来
-func (fifo *ResourceFifo) Wait(resourceVersion string) error {
-	resVerion, err := strconv.ParseInt(resourceVersion, 10, 64)
-	if err != nil {
-		return err
+	it := fifo.list.Remove(keyEle).(*Item)
+	if it.key > fifo.oldest {
+		fifo.oldest = it.key
 	}
+}
 
+// 等待，直到序号seq之后有新的事件提交，最多等待1秒
+func (fifo *ResourceFifo) Wait(seq int64) {
 	fifo.cond.L.Lock()
-	if resVerion == fifo.version {
+	if seq >= fifo.seq {
 		fifo.cond.WaitWithTimeout(time.Second)
 	}
 	fifo.cond.L.Unlock()
+}
+
+// 等待缓存追上resourceVersion，超时返回`504 Timeout`，与apiserver的"Too large resource version"一致
+func (fifo *ResourceFifo) WaitFor(rv int64, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	fifo.cond.L.Lock()
+	defer fifo.cond.L.Unlock()
+	for fifo.version < rv {
+		if time.Now().After(deadline) {
+			err := apierrors.NewTimeoutError(fmt.Sprintf("Too large resource version: %v, current: %v", rv, fifo.version), 1)
+			err.ErrStatus.Details.Causes = []metav1.StatusCause{{Type: metav1.CauseTypeResourceVersionTooLarge, Message: "Too large resource version"}}
+			return err
+		}
+		fifo.cond.WaitWithTimeout(time.Until(deadline))
+	}
 	return nil
 }
 
+// 缓存中对象的最新resourceVersion，List的结果至少与此版本一样新
 func (fifo *ResourceFifo) Version() string {
+	fifo.mu.RLock()
+	defer fifo.mu.RUnlock()
 	return fmt.Sprintf("%d", fifo.version)
 }
+
+// 可以提供的最早resourceVersion，以及保存的事件数
+func (fifo *ResourceFifo) Window() (string, int) {
+	fifo.mu.RLock()
+	defer fifo.mu.RUnlock()
+	return fmt.Sprintf("%d", fifo.oldest), fifo.list.Len()
+}
+
+func parseResourceVersion(resourceVersion string) (int64, error) {
+	resVerion, err := strconv.ParseInt(resourceVersion, 10, 64)
+	if err != nil || resVerion < 0 {
+		return 0, apierrors.NewBadRequest(fmt.Sprintf("invalid resource version: %v", resourceVersion))
+	}
+	return resVerion, nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func testObject(name string, rv int64) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion("v1")
+	obj.SetKind("ConfigMap")
+	obj.SetNamespace("default")
+	obj.SetName(name)
+	obj.SetResourceVersion(fmt.Sprintf("%d", rv))
+	return obj
+}
+
+func pushObject(fifo *ResourceFifo, name string, rv int64) {
+	fifo.Push(&metav1.WatchEvent{Type: "ADDED", Object: runtime.RawExtension{Object: testObject(name, rv)}}, nil)
+}
+
+// informer送达事件并推进它的版本
+func deliverObject(fifo *ResourceFifo, source int, name string, rv int64) {
+	pushObject(fifo, name, rv)
+	fifo.Advance(source, rv)
+}
+
+// 一个informer，初始列表的版本为10，之后依次收到11、12、13
+func newTestFifo(size int) *ResourceFifo {
+	fifo := NewResourceFifo(size)
+	source := fifo.AddSource()
+	fifo.Advance(source, 10)
+	fifo.Start()
+	for rv := int64(11); rv <= 13; rv++ {
+		deliverObject(fifo, source, fmt.Sprintf("c%d", rv), rv)
+	}
+	return fifo
+}
+
+func itemKeys(items []*Item) []int64 {
+	keys := []int64{}
+	for _, it := range items {
+		keys = append(keys, it.key)
+	}
+	return keys
+}
+
+func TestResourceFifoGet(t *testing.T) {
+	fifo := newTestFifo(MAX_RESOURCE_FIFO_LEN)
+	tests := []struct {
+		resourceVersion string
+		want            []int64
+		gone            bool
+	}{
+		{resourceVersion: "10", want: []int64{11, 12, 13}},
+		{resourceVersion: "11", want: []int64{12, 13}},
+		{resourceVersion: "13", want: []int64{}},
+		{resourceVersion: "20", want: []int64{}},
+		{resourceVersion: "9", gone: true},
+	}
+	for _, tt := range tests {
+		items, seq, err := fifo.Get(tt.resourceVersion)
+		if tt.gone {
+			if !apierrors.IsResourceExpired(err) {
+				t.Errorf("Get(%v) error = %v, want 410", tt.resourceVersion, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Get(%v) error = %v", tt.resourceVersion, err)
+		}
+		if got := itemKeys(items); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("Get(%v) = %v, want %v", tt.resourceVersion, got, tt.want)
+		}
+		if seq != 3 {
+			t.Errorf("Get(%v) seq = %v, want 3", tt.resourceVersion, seq)
+		}
+	}
+	if _, _, err := fifo.Get("abc"); !apierrors.IsBadRequest(err) {
+		t.Errorf("Get(abc) error = %v, want 400", err)
+	}
+}
+
+func TestResourceFifoVersion(t *testing.T) {
+	fifo := NewResourceFifo(MAX_RESOURCE_FIFO_LEN)
+	source := fifo.AddSource()
+	fifo.Advance(source, 10)
+	fifo.Start()
+	if v := fifo.Version(); v != "10" {
+		t.Fatalf("Version() = %v, want 10", v)
+	}
+	// 版本只随informer的进度前进，Get(Version())不会错过之后提交的事件
+	version := fifo.Version()
+	pushObject(fifo, "b", 12)
+	if items, _, err := fifo.Get(version); err != nil || len(items) != 0 || fifo.Version() != "10" {
+		t.Fatalf("Get(%v) = %v, %v, Version() = %v, want no events before the informer advances", version, itemKeys(items), err, fifo.Version())
+	}
+	fifo.Advance(source, 12)
+	items, _, err := fifo.Get(version)
+	if err != nil || fmt.Sprint(itemKeys(items)) != "[12]" {
+		t.Fatalf("Get(%v) = %v, %v, want [12]", version, itemKeys(items), err)
+	}
+	if v := fifo.Version(); v != "12" {
+		t.Fatalf("Version() = %v, want 12", v)
+	}
+	// BOOKMARK推进版本，不产生事件
+	fifo.Advance(source, 15)
+	if items, _, err := fifo.Get("12"); err != nil || len(items) != 0 || fifo.Version() != "15" {
+		t.Fatalf("Get(12) = %v, %v, Version() = %v, want no events at 15", itemKeys(items), err, fifo.Version())
+	}
+}
+
+func TestResourceFifoNext(t *testing.T) {
+	fifo := NewResourceFifo(MAX_RESOURCE_FIFO_LEN)
+	a, b := fifo.AddSource(), fifo.AddSource()
+	fifo.Advance(a, 13)
+	fifo.Advance(b, 13)
+	fifo.Start()
+	_, seq, err := fifo.Get("13")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if items, next, err := fifo.Next(seq); err != nil || len(items) != 0 || next != seq {
+		t.Fatalf("Next(%v) = %v, %v, %v, want no events", seq, itemKeys(items), next, err)
+	}
+
+	// 另一个informer还没有送达之前的事件，15等待它追上
+	deliverObject(fifo, a, "d", 15)
+	if items, _, _ := fifo.Next(seq); len(items) != 0 || fifo.Version() != "13" {
+		t.Fatalf("Next(%v) = %v, Version() = %v, want 15 held back at 13", seq, itemKeys(items), fifo.Version())
+	}
+	deliverObject(fifo, b, "e", 14)
+	items, next, err := fifo.Next(seq)
+	if err != nil || fmt.Sprint(itemKeys(items)) != "[14]" || next != seq+1 {
+		t.Fatalf("Next(%v) = %v, %v, %v, want [14]", seq, itemKeys(items), next, err)
+	}
+	fifo.Advance(b, 16)
+	if items, _, err := fifo.Next(next); err != nil || fmt.Sprint(itemKeys(items)) != "[15]" {
+		t.Errorf("Next(%v) = %v, %v, want [15]", next, itemKeys(items), err)
+	}
+	// 事件保留上游的resourceVersion，从14开始的watch仍能读到15
+	if items, _, err := fifo.Get("14"); err != nil || fmt.Sprint(itemKeys(items)) != "[15]" {
+		t.Errorf("Get(14) = %v, %v, want [15]", itemKeys(items), err)
+	}
+	if v := fifo.Version(); v != "15" {
+		t.Errorf("Version() = %v, want 15", v)
+	}
+
+	// 未读的事件被移除后返回410
+	small := newTestFifo(2)
+	for rv := int64(14); rv <= 16; rv++ {
+		deliverObject(small, 0, fmt.Sprintf("f%d", rv), rv)
+	}
+	if _, _, err := small.Next(3); !apierrors.IsResourceExpired(err) {
+		t.Errorf("Next(3) error = %v, want 410", err)
+	}
+	if items, _, err := small.Next(4); err != nil || fmt.Sprint(itemKeys(items)) != "[15 16]" {
+		t.Errorf("Next(4) = %v, %v, want [15 16]", itemKeys(items), err)
+	}
+}
+
+// 等待的事件超过size时不再等待落后的informer
+func TestResourceFifoPendingOverflow(t *testing.T) {
+	fifo := NewResourceFifo(2)
+	a, b := fifo.AddSource(), fifo.AddSource()
+	fifo.Advance(a, 10)
+	fifo.Advance(b, 10)
+	fifo.Start()
+	for rv := int64(11); rv <= 13; rv++ {
+		deliverObject(fifo, a, fmt.Sprintf("c%d", rv), rv)
+	}
+	items, _, err := fifo.Get("10")
+	if err != nil || fmt.Sprint(itemKeys(items)) != "[11]" || fifo.Version() != "11" {
+		t.Fatalf("Get(10) = %v, %v, Version() = %v, want [11] at 11", itemKeys(items), err, fifo.Version())
+	}
+	// 落后的informer之后送达的更早事件沿用当前版本
+	deliverObject(fifo, b, "d", 11)
+	if items, _, err := fifo.Get("10"); err != nil || fmt.Sprint(itemKeys(items)) != "[11 11]" {
+		t.Errorf("Get(10) = %v, %v, want [11 11]", itemKeys(items), err)
+	}
+}
+
+func TestResourceFifoWaitFor(t *testing.T) {
+	fifo := newTestFifo(MAX_RESOURCE_FIFO_LEN)
+	if err := fifo.WaitFor(13, 0); err != nil {
+		t.Fatalf("WaitFor(13) error = %v", err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		deliverObject(fifo, 0, "d", 14)
+	}()
+	start := time.Now()
+	if err := fifo.WaitFor(14, time.Second); err != nil {
+		t.Fatalf("WaitFor(14) error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("WaitFor(14) took %v, want to return on push", elapsed)
+	}
+
+	err := fifo.WaitFor(20, 50*time.Millisecond)
+	if !apierrors.IsTimeout(err) || !apierrors.HasStatusCause(err, metav1.CauseTypeResourceVersionTooLarge) {
+		t.Errorf("WaitFor(20) error = %v, want 504 with ResourceVersionTooLarge", err)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/anhk/kube-relay/pkg/k8s"
+	"github.com/anhk/kube-relay/pkg/log"
+	"github.com/gin-gonic/gin"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/duration"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/util/jsonpath"
+)
+
+var crdGVR = schema.GroupVersionResource{Group: "apiextensions.k8s.io", Version: "v1", Resource: "customresourcedefinitions"}
+
+// Table的一列，JSONPath为空表示Name列
+type TableColumn struct {
+	Definition metav1.TableColumnDefinition
+	JSONPath   string
+}
+
+var (
+	nameColumn = TableColumn{Definition: metav1.TableColumnDefinition{
+		Name: "Name", Type: "string", Format: "name", Description: metav1.ObjectMeta{}.SwaggerDoc()["name"],
+	}}
+	ageColumn = newTableColumn(metav1.TableColumnDefinition{
+		Name: "Age", Type: "date", Description: metav1.ObjectMeta{}.SwaggerDoc()["creationTimestamp"],
+	}, ".metadata.creationTimestamp")
+)
+
+func newTableColumn(def metav1.TableColumnDefinition, path string) TableColumn {
+	return TableColumn{Definition: def, JSONPath: path}
+}
+
+// JSONPath在求值时会修改内部状态，每次转换都需要重新解析
+func (col *TableColumn) parse() *jsonpath.JSONPath {
+	if col.JSONPath == "" {
+		return nil
+	}
+	jp := jsonpath.New(col.Definition.Name).AllowMissingKeys(true)
+	if err := jp.Parse(fmt.Sprintf("{%v}", col.JSONPath)); err != nil {
+		log.Warn("invalid jsonPath %v for column %v: %v", col.JSONPath, col.Definition.Name, err)
+		return nil
+	}
+	return jp
+}
+
+// 从CRD定义中读取additionalPrinterColumns，内置类型及没有定义的CRD使用默认的Name/Age列
+func (res *ResourceHandler) LoadTableColumns(dynamicClient dynamic.Interface) {
+	res.columns = []TableColumn{nameColumn, ageColumn}
+	if scheme.Scheme.Recognizes(res.GVK()) { // 内置类型
+		return
+	}
+
+	crd, err := dynamicClient.Resource(crdGVR).Get(context.Background(), res.GVR.GroupResource().String(), metav1.GetOptions{})
+	if err != nil {
+		log.Debug("no CustomResourceDefinition for %v: %v", res.GVR, err)
+		return
+	}
+	versions, _, _ := unstructured.NestedSlice(crd.Object, "spec", "versions")
+	for _, v := range versions {
+		version, ok := v.(map[string]any)
+		if !ok || version["name"] != res.GVR.Version {
+			continue
+		}
+		printerColumns, _, _ := unstructured.NestedSlice(version, "additionalPrinterColumns")
+		if len(printerColumns) == 0 {
+			return
+		}
+		res.columns = []TableColumn{nameColumn}
+		for _, c := range printerColumns {
+			col, ok := c.(map[string]any)
+			if !ok {
+				continue
+			}
+			def := metav1.TableColumnDefinition{}
+			def.Name, _, _ = unstructured.NestedString(col, "name")
+			def.Type, _, _ = unstructured.NestedString(col, "type")
+			def.Format, _, _ = unstructured.NestedString(col, "format")
+			def.Description, _, _ = unstructured.NestedString(col, "description")
+			priority, _, _ := unstructured.NestedInt64(col, "priority")
+			def.Priority = int32(priority)
+			path, _, _ := unstructured.NestedString(col, "jsonPath")
+			res.columns = append(res.columns, newTableColumn(def, path))
+		}
+		return
+	}
+}
+
+// 将对象转换为Table
+func (res *ResourceHandler) toTable(objs []runtime.Object, includeObject metav1.IncludeObjectPolicy) *metav1.Table {
+	table := &metav1.Table{Rows: []metav1.TableRow{}}
+	paths := make([]*jsonpath.JSONPath, len(res.columns))
+	for i, col := range res.columns {
+		table.ColumnDefinitions = append(table.ColumnDefinitions, col.Definition)
+		paths[i] = col.parse()
+	}
+
+	for _, obj := range objs {
+		utd, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			utd = k8s.ObjectToUnstructured(obj)
+		}
+
+		row := metav1.TableRow{}
+		for i, col := range res.columns {
+			row.Cells = append(row.Cells, cellValue(utd, col.Definition.Type, paths[i]))
+		}
+		switch includeObject {
+		case metav1.IncludeObject:
+			row.Object = runtime.RawExtension{Object: obj}
+		case metav1.IncludeNone:
+		default:
+			row.Object = runtime.RawExtension{Object: toPartialObjectMetadata(obj)}
+		}
+		table.Rows = append(table.Rows, row)
+	}
+	return table
+}
+
+func cellValue(utd *unstructured.Unstructured, colType string, jp *jsonpath.JSONPath) any {
+	if jp == nil {
+		return utd.GetName()
+	}
+	results, err := jp.FindResults(utd.Object)
+	if err != nil || len(results) == 0 || len(results[0]) == 0 {
+		return nil
+	}
+
+	value := results[0][0].Interface()
+	switch colType {
+	case "date":
+		if s, ok := value.(string); ok {
+			if ts, err := time.Parse(time.RFC3339, s); err == nil {
+				return duration.HumanDuration(time.Since(ts))
+			}
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			data, _ := json.Marshal(value)
+			return string(data)
+		}
+	}
+	return value
+}
+
+// 以Table形式输出，对应Accept: application/json;as=Table;g=meta.k8s.io;v=v1
+type tableCodec struct {
+	jsonCodec
+	res           *ResourceHandler
+	version       string
+	includeObject metav1.IncludeObjectPolicy
+}
+
+func newTableCodec(ctx *gin.Context, res *ResourceHandler, version string) *tableCodec {
+	includeObject := metav1.IncludeObjectPolicy(ctx.DefaultQuery("includeObject", string(metav1.IncludeMetadata)))
+	return &tableCodec{res: res, version: version, includeObject: includeObject}
+}
+
+func (c *tableCodec) table(objs []runtime.Object) *metav1.Table {
+	table := c.res.toTable(objs, c.includeObject)
+	table.APIVersion = "meta.k8s.io/" + c.version
+	table.Kind = "Table"
+	return table
+}
+
+func (c *tableCodec) WriteObject(ctx *gin.Context, code int, obj runtime.Object) {
+	switch t := obj.(type) {
+	case *metav1.Status:
+		c.jsonCodec.WriteObject(ctx, code, obj)
+	case *ListWrapper:
+		table := c.table(t.Items)
+		table.ListMeta = t.Metadata
+		c.jsonCodec.WriteObject(ctx, code, table)
+	default:
+		table := c.table([]runtime.Object{obj})
+		if accessor, err := meta.Accessor(obj); err == nil {
+			table.ResourceVersion = accessor.GetResourceVersion()
+		}
+		c.jsonCodec.WriteObject(ctx, code, table)
+	}
+}
+
+func (c *tableCodec) WriteEvent(ctx *gin.Context, event *metav1.WatchEvent) {
+	switch event.Type {
+	case "ADDED", "MODIFIED", "DELETED":
+		table := c.table([]runtime.Object{event.Object.Object})
+		event = &metav1.WatchEvent{Type: event.Type, Object: runtime.RawExtension{Object: table}}
+	}
+	c.jsonCodec.WriteEvent(ctx, event)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/cache"
+)
+
+// 不能删除的字段，缺少后客户端无法识别对象
+var protectedFields = []string{"apiVersion", "kind", "metadata", "metadata.name", "metadata.namespace", "metadata.uid", "metadata.resourceVersion"}
+
+// 解析JSON路径，如.status.conditions
+func parseFieldPath(path string) ([]string, error) {
+	if !strings.HasPrefix(path, ".") || len(path) == 1 {
+		return nil, fmt.Errorf("invalid path %q, expected .<field>[.<field>...]", path)
+	}
+	fields := strings.Split(path[1:], ".")
+	for _, field := range fields {
+		if field == "" {
+			return nil, fmt.Errorf("invalid path %q, empty field", path)
+		}
+	}
+	if slices.Contains(protectedFields, path[1:]) {
+		return nil, fmt.Errorf("path %q can not be dropped", path)
+	}
+	return fields, nil
+}
+
+func (t *TransformConfig) Validate() error {
+	for _, path := range t.DropFields {
+		if _, err := parseFieldPath(path); err != nil {
+			return fmt.Errorf("dropFields: %v", err)
+		}
+	}
+	for _, prefix := range t.StripAnnotations {
+		if prefix == "" {
+			return fmt.Errorf("stripAnnotations: empty prefix")
+		}
+	}
+	return nil
+}
+
+// 对象进入informer缓存前的修改，list、get及watch输出的都是修改后的对象；
+// 同一对象可能被处理多次，修改需要幂等
+func (res *ResourceConfig) transform() cache.TransformFunc {
+	if res == nil || res.Transforms.Empty() {
+		return nil
+	}
+	t := res.Transforms
+	var paths [][]string
+	for _, path := range t.DropFields {
+		fields, _ := parseFieldPath(path) // 已经校验过
+		paths = append(paths, fields)
+	}
+	return func(obj any) (any, error) {
+		u, ok := obj.(*unstructured.Unstructured)
+		if !ok { // DeletedFinalStateUnknown中的对象已经处理过
+			return obj, nil
+		}
+		for _, fields := range paths {
+			unstructured.RemoveNestedField(u.Object, fields...)
+		}
+		if t.TrimManagedFields {
+			u.SetManagedFields(nil)
+		}
+		if annotations := u.GetAnnotations(); len(annotations) > 0 && len(t.StripAnnotations) > 0 {
+			for key := range annotations {
+				for _, prefix := range t.StripAnnotations {
+					if strings.HasPrefix(key, prefix) {
+						delete(annotations, key)
+						break
+					}
+				}
+			}
+			if len(annotations) == 0 { // 与apiserver一致，不输出空的annotations
+				annotations = nil
+			}
+			u.SetAnnotations(annotations)
+		}
+		return u, nil
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestParseFieldPath(t *testing.T) {
+	tests := []struct {
+		path    string
+		want    []string
+		wantErr bool
+	}{
+		{path: ".status", want: []string{"status"}},
+		{path: ".metadata.labels", want: []string{"metadata", "labels"}},
+		{path: ".spec.template.spec", want: []string{"spec", "template", "spec"}},
+		{path: "status", wantErr: true},
+		{path: ".", wantErr: true},
+		{path: ".spec..template", wantErr: true},
+		{path: ".status.", wantErr: true},
+		{path: ".apiVersion", wantErr: true},
+		{path: ".kind", wantErr: true},
+		{path: ".metadata", wantErr: true},
+		{path: ".metadata.name", wantErr: true},
+		{path: ".metadata.namespace", wantErr: true},
+		{path: ".metadata.uid", wantErr: true},
+		{path: ".metadata.resourceVersion", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseFieldPath(tt.path)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseFieldPath(%q) error = %v, wantErr %v", tt.path, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseFieldPath(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func transformObject() *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	if err := obj.UnmarshalJSON([]byte(`{"apiVersion":"v1","kind":"Pod","metadata":{"name":"p","namespace":"default","uid":"u","resourceVersion":"10",` +
+		`"annotations":{"kubectl.kubernetes.io/last-applied-configuration":"{}","example.com/keep":"v","example.com/drop":"v"},` +
+		`"managedFields":[{"manager":"kubectl","operation":"Apply"}]},` +
+		`"spec":{"nodeName":"n","containers":[{"name":"c"}]},"status":{"phase":"Running","conditions":[{"type":"Ready"}]}}`)); err != nil {
+		panic(err)
+	}
+	return obj
+}
+
+func TestTransform(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    TransformConfig
+		check     func(u *unstructured.Unstructured) bool
+		unchanged bool
+	}{
+		{
+			name:   "drop fields",
+			config: TransformConfig{DropFields: []string{".status.conditions", ".spec.nodeName", ".spec.missing.field"}},
+			check: func(u *unstructured.Unstructured) bool {
+				_, conditions, _ := unstructured.NestedSlice(u.Object, "status", "conditions")
+				_, nodeName, _ := unstructured.NestedString(u.Object, "spec", "nodeName")
+				phase, _, _ := unstructured.NestedString(u.Object, "status", "phase")
+				return !conditions && !nodeName && phase == "Running"
+			},
+		},
+		{
+			name:   "strip annotations by prefix",
+			config: TransformConfig{StripAnnotations: []string{"kubectl.kubernetes.io/", "example.com/drop"}},
+			check: func(u *unstructured.Unstructured) bool {
+				return reflect.DeepEqual(u.GetAnnotations(), map[string]string{"example.com/keep": "v"})
+			},
+		},
+		{
+			name:   "strip all annotations",
+			config: TransformConfig{StripAnnotations: []string{"kubectl.kubernetes.io/", "example.com/"}},
+			check: func(u *unstructured.Unstructured) bool {
+				_, found, _ := unstructured.NestedMap(u.Object, "metadata", "annotations")
+				return !found
+			},
+		},
+		{
+			name:   "trim managedFields",
+			config: TransformConfig{TrimManagedFields: true},
+			check: func(u *unstructured.Unstructured) bool {
+				_, found, _ := unstructured.NestedSlice(u.Object, "metadata", "managedFields")
+				return !found && len(u.GetAnnotations()) == 3
+			},
+		},
+		{
+			name:   "identity fields are kept",
+			config: TransformConfig{DropFields: []string{".metadata.labels", ".status"}, TrimManagedFields: true, StripAnnotations: []string{"example.com/"}},
+			check: func(u *unstructured.Unstructured) bool {
+				return u.GetAPIVersion() == "v1" && u.GetKind() == "Pod" && u.GetName() == "p" && u.GetNamespace() == "default" &&
+					u.GetUID() == "u" && u.GetResourceVersion() == "10"
+			},
+		},
+		{name: "no transforms", config: TransformConfig{}, unchanged: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fn := (&ResourceConfig{Name: "pods", Transforms: tt.config}).transform()
+			if tt.unchanged {
+				if fn != nil {
+					t.Fatal("transform() is not nil without transforms")
+				}
+				return
+			}
+			if err := tt.config.Validate(); err != nil {
+				t.Fatalf("Validate() error = %v", err)
+			}
+
+			once := apply(t, fn, transformObject())
+			if !tt.check(once) {
+				t.Errorf("transformed object = %v", once.Object)
+			}
+			// informer可能重复处理同一对象
+			twice := apply(t, fn, once.DeepCopy())
+			if !reflect.DeepEqual(once.Object, twice.Object) {
+				t.Errorf("transform is not idempotent: %v, then %v", once.Object, twice.Object)
+			}
+		})
+	}
+
+	// 非Unstructured的对象原样返回
+	tombstone := cache.DeletedFinalStateUnknown{Key: "default/p", Obj: transformObject()}
+	fn := (&ResourceConfig{Name: "pods", Transforms: TransformConfig{TrimManagedFields: true}}).transform()
+	if got, err := fn(tombstone); err != nil || !reflect.DeepEqual(got, tombstone) {
+		t.Errorf("transform(tombstone) = %v, %v, want it unchanged", got, err)
+	}
+}
+
+func apply(t *testing.T, fn cache.TransformFunc, obj *unstructured.Unstructured) *unstructured.Unstructured {
+	got, err := fn(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got.(*unstructured.Unstructured)
+}
+
+func TestTransformConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  TransformConfig
+		wantErr bool
+	}{
+		{name: "valid", config: TransformConfig{DropFields: []string{".status"}, StripAnnotations: []string{"example.com/"}, TrimManagedFields: true}},
+		{name: "protected path", config: TransformConfig{DropFields: []string{".metadata.name"}}, wantErr: true},
+		{name: "invalid path", config: TransformConfig{DropFields: []string{"status"}}, wantErr: true},
+		{name: "empty prefix", config: TransformConfig{StripAnnotations: []string{""}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := tt.config.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%v: Validate() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -1 +1,51 @@
 package main
+
+import (
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// 将错误转换为metav1.Status，非APIStatus的错误作为InternalError处理
+func errorStatus(err error) *metav1.Status {
+	var status metav1.Status
+	if apiStatus, ok := err.(apierrors.APIStatus); ok {
+		status = apiStatus.Status()
+	} else {
+		status = apierrors.NewInternalError(err).Status()
+	}
+	status.Kind = "Status"
+	status.APIVersion = "v1"
+	return &status
+}
+
+// 503错误，retryAfter为建议客户端重试的秒数
+func serviceUnavailable(message string, retryAfter int32) error {
+	err := apierrors.NewServiceUnavailable(message)
+	err.ErrStatus.Details = &metav1.StatusDetails{RetryAfterSeconds: retryAfter}
+	return err
+}
+
+// 以metav1.Status的格式返回错误
+func abortWithStatus(ctx *gin.Context, err error) {
+	status := errorStatus(err)
+	if status.Details != nil && status.Details.RetryAfterSeconds > 0 {
+		ctx.Header("Retry-After", fmt.Sprintf("%d", status.Details.RetryAfterSeconds))
+	}
+	ctx.AbortWithStatusJSON(int(status.Code), status)
+}
+
+// Watch流已经开始后，以ERROR事件的方式返回错误
+func writeErrorEvent(ctx *gin.Context, codec ResponseCodec, err error) {
+	codec.WriteEvent(ctx, &metav1.WatchEvent{Type: "ERROR", Object: runtime.RawExtension{Object: errorStatus(err)}})
+	ctx.Writer.Flush()
+}
+
+// 未注册的路径返回404
+func notFound(ctx *gin.Context) {
+	abortWithStatus(ctx, apierrors.NewGenericServerResponse(404, ctx.Request.Method, schema.GroupResource{}, "", "the server could not find the requested resource", 0, false))
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var lastWatcherID uint64
+
+// 正在进行的watch，可以通过管理接口断开
+type Watcher struct {
+	ID        uint64    `json:"id"`
+	Resource  string    `json:"resource"`
+	Namespace string    `json:"namespace,omitempty"`
+	Name      string    `json:"name,omitempty"`
+	Remote    string    `json:"remote"`
+	UserAgent string    `json:"userAgent,omitempty"`
+	Since     time.Time `json:"since"`
+
+	stopCh   chan struct{}
+	stopOnce sync.Once
+}
+
+// 结束watch，客户端收到正常的流结束后重新发起
+func (w *Watcher) Stop() {
+	w.stopOnce.Do(func() { close(w.stopCh) })
+}
+
+func (w *Watcher) Stopped() bool {
+	select {
+	case <-w.stopCh:
+		return true
+	default:
+		return false
+	}
+}
+
+func (res *ResourceHandler) addWatcher(ctx *gin.Context) *Watcher {
+	w := &Watcher{
+		ID:        atomic.AddUint64(&lastWatcherID, 1),
+		Resource:  resourceArg(res.GVR),
+		Namespace: ctx.Param("namespace"),
+		Name:      ctx.Param("name"),
+		Remote:    ctx.Request.RemoteAddr,
+		UserAgent: ctx.Request.UserAgent(),
+		Since:     time.Now(),
+		stopCh:    make(chan struct{}),
+	}
+	res.watchMu.Lock()
+	defer res.watchMu.Unlock()
+	res.watchers[w.ID] = w
+	return w
+}
+
+func (res *ResourceHandler) removeWatcher(w *Watcher) {
+	res.watchMu.Lock()
+	defer res.watchMu.Unlock()
+	delete(res.watchers, w.ID)
+	res.touch() // 长时间的watch结束后从此时计算空闲，客户端重连前informer不会被停止
+}
+
+func (res *ResourceHandler) watcherCount() int {
+	res.watchMu.Lock()
+	defer res.watchMu.Unlock()
+	return len(res.watchers)
+}
+
+// 正在进行的watch
+func (res *ResourceHandler) Watchers() []*Watcher {
+	res.watchMu.Lock()
+	defer res.watchMu.Unlock()
+	result := make([]*Watcher, 0, len(res.watchers))
+	for _, w := range res.watchers {
+		result = append(result, w)
+	}
+	return result
+}
+
+// 断开指定的watch
+func (res *ResourceHandler) DisconnectWatcher(id uint64) bool {
+	res.watchMu.Lock()
+	w, ok := res.watchers[id]
+	res.watchMu.Unlock()
+	if ok {
+		w.Stop()
+		res.fifo.cond.Broadcast() // 唤醒等待事件的watch
+	}
+	return ok
+}
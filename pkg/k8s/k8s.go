@@ -13,13 +13,18 @@ import (
 	"k8s.io/client-go/tools/clientcmd"
 )
 
+// 访问上游apiserver的限速
+var (
+	QPS   float32 = 1000
+	Burst         = 5000
+)
+
+// 将<resource>[.<group>][/<version>]拆分为GVR，未指定的部分为空，由ResolveResources补全
 func ProcessResource(arg string) schema.GroupVersionResource {
 	gvr := schema.GroupVersionResource{}
 	if i := strings.Index(arg, "/"); i >= 0 {
 		gvr.Version = arg[i+1:]
 		arg = arg[:i]
-	} else {
-		gvr.Version = "v1"
 	}
 
 	if i := strings.Index(arg, "."); i >= 0 {
@@ -42,11 +47,16 @@ func processRestConfig(kubeConfigFile, apiServer string) (*rest.Config, error) {
 	} else if clientconfig, err = rest.InClusterConfig(); err != nil {
 		return nil, fmt.Errorf("unable to initialize inclusterconfig: " + err.Error())
 	}
-	clientconfig.QPS = 1000
-	clientconfig.Burst = 5000
+	clientconfig.QPS = QPS
+	clientconfig.Burst = Burst
 	return clientconfig, nil
 }
 
+// 上游apiserver的连接配置，与客户端使用同一来源
+func CreateRestConfig(kubeConfigFile, apiServer string) (*rest.Config, error) {
+	return processRestConfig(kubeConfigFile, apiServer)
+}
+
 func CreateKubeClient(kubeConfigFile, apiServer string) (*kubernetes.Clientset, error) {
 	clientconfig, err := processRestConfig(kubeConfigFile, apiServer)
 	if err != nil {
@@ -0,0 +1,105 @@
+package k8s
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/anhk/kube-relay/pkg/log"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/restmapper"
+)
+
+// 解析结果，Arg为匹配到该资源的第一个参数的下标
+type ResolvedResource struct {
+	GVR schema.GroupVersionResource
+	Arg int
+}
+
+// 通过discovery解析资源参数，参数格式为<resource>[.<group>][/<version>]：
+//   - resource可以是复数、单数、短名称或Kind，如svc、Service、endpointslice.discovery.k8s.io
+//   - 未指定version时使用group的preferredVersion
+//   - 支持通配符，如*.discovery.k8s.io、networking.k8s.io/*，只匹配支持list及watch的资源
+//   - 以-开头的参数表示排除，如-events.events.k8s.io
+func ResolveResources(client discovery.DiscoveryInterface, args []string) ([]ResolvedResource, error) {
+	groupResources, err := restmapper.GetAPIGroupResources(client)
+	if err != nil {
+		return nil, err
+	}
+	mapper := restmapper.NewShortcutExpander(restmapper.NewDiscoveryRESTMapper(groupResources), client, func(msg string) { log.Warn("%v", msg) })
+
+	var result []ResolvedResource
+	seen := make(map[schema.GroupVersionResource]bool)
+	excluded := make(map[schema.GroupVersionResource]bool)
+	for i, arg := range args {
+		exclude := strings.HasPrefix(arg, "-")
+		arg = strings.TrimPrefix(arg, "-")
+
+		var gvrs []schema.GroupVersionResource
+		if strings.Contains(arg, "*") {
+			gvrs = matchResources(groupResources, arg)
+		} else {
+			gvr, err := mapper.ResourceFor(ProcessResource(arg))
+			if err != nil {
+				return nil, fmt.Errorf("resolve resource %v: %v", arg, err)
+			}
+			gvrs = []schema.GroupVersionResource{gvr}
+		}
+
+		for _, gvr := range gvrs {
+			if exclude {
+				excluded[gvr] = true
+			} else if !seen[gvr] {
+				seen[gvr] = true
+				result = append(result, ResolvedResource{GVR: gvr, Arg: i})
+			}
+		}
+	}
+
+	filtered := make([]ResolvedResource, 0, len(result))
+	for _, res := range result {
+		if !excluded[res.GVR] {
+			filtered = append(filtered, res)
+		}
+	}
+	return filtered, nil
+}
+
+// 按通配符匹配资源，<group>/*表示group下的全部资源
+func matchResources(groupResources []*restmapper.APIGroupResources, pattern string) []schema.GroupVersionResource {
+	want := ProcessResource(pattern)
+	if group, ok := strings.CutSuffix(pattern, "/*"); ok { // networking.k8s.io/*
+		want = schema.GroupVersionResource{Group: group, Resource: "*"}
+	}
+
+	var result []schema.GroupVersionResource
+	for _, gr := range groupResources {
+		if ok, _ := path.Match(want.Group, gr.Group.Name); !ok {
+			continue
+		}
+		version := gr.Group.PreferredVersion.Version
+		if want.Version != "" {
+			version = want.Version
+		}
+		for _, res := range gr.VersionedResources[version] {
+			if strings.Contains(res.Name, "/") || !listAndWatch(res) { // 子资源
+				continue
+			}
+			if ok, _ := path.Match(want.Resource, res.Name); ok {
+				result = append(result, schema.GroupVersionResource{Group: gr.Group.Name, Version: version, Resource: res.Name})
+			}
+		}
+	}
+	return result
+}
+
+func listAndWatch(res metav1.APIResource) bool {
+	var list, watch bool
+	for _, verb := range res.Verbs {
+		list = list || verb == "list"
+		watch = watch || verb == "watch"
+	}
+	return list && watch
+}
@@ -0,0 +1,96 @@
+package k8s
+
+import (
+	"fmt"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+var (
+	listWatch = metav1.Verbs{"get", "list", "watch"}
+
+	services       = schema.GroupVersionResource{Version: "v1", Resource: "services"}
+	pods           = schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+	endpointslices = schema.GroupVersionResource{Group: "discovery.k8s.io", Version: "v1", Resource: "endpointslices"}
+	ingresses      = schema.GroupVersionResource{Group: "networking.k8s.io", Version: "v1", Resource: "ingresses"}
+	ingressclasses = schema.GroupVersionResource{Group: "networking.k8s.io", Version: "v1", Resource: "ingressclasses"}
+	networkpolices = schema.GroupVersionResource{Group: "networking.k8s.io", Version: "v1", Resource: "networkpolicies"}
+	ingressesBeta  = schema.GroupVersionResource{Group: "networking.k8s.io", Version: "v1beta1", Resource: "ingresses"}
+)
+
+func newFakeDiscovery() *fakediscovery.FakeDiscovery {
+	return &fakediscovery.FakeDiscovery{Fake: &clienttesting.Fake{Resources: []*metav1.APIResourceList{
+		{GroupVersion: "v1", APIResources: []metav1.APIResource{
+			{Name: "pods", SingularName: "pod", Namespaced: true, Kind: "Pod", Verbs: listWatch, ShortNames: []string{"po"}},
+			{Name: "pods/log", Namespaced: true, Kind: "Pod", Verbs: metav1.Verbs{"get"}},
+			{Name: "services", SingularName: "service", Namespaced: true, Kind: "Service", Verbs: listWatch, ShortNames: []string{"svc"}},
+			{Name: "bindings", SingularName: "binding", Namespaced: true, Kind: "Binding", Verbs: metav1.Verbs{"create"}},
+		}},
+		{GroupVersion: "discovery.k8s.io/v1", APIResources: []metav1.APIResource{
+			{Name: "endpointslices", SingularName: "endpointslice", Namespaced: true, Kind: "EndpointSlice", Verbs: listWatch},
+		}},
+		{GroupVersion: "networking.k8s.io/v1", APIResources: []metav1.APIResource{
+			{Name: "ingresses", SingularName: "ingress", Namespaced: true, Kind: "Ingress", Verbs: listWatch, ShortNames: []string{"ing"}},
+			{Name: "ingressclasses", SingularName: "ingressclass", Kind: "IngressClass", Verbs: listWatch},
+			{Name: "networkpolicies", SingularName: "networkpolicy", Namespaced: true, Kind: "NetworkPolicy", Verbs: listWatch, ShortNames: []string{"netpol"}},
+		}},
+		{GroupVersion: "networking.k8s.io/v1beta1", APIResources: []metav1.APIResource{
+			{Name: "ingresses", SingularName: "ingress", Namespaced: true, Kind: "Ingress", Verbs: listWatch},
+		}},
+	}}}
+}
+
+func TestResolveResources(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    []ResolvedResource
+		wantErr bool
+	}{
+		{name: "short name", args: []string{"svc"}, want: []ResolvedResource{{services, 0}}},
+		{name: "kind", args: []string{"Service"}, want: []ResolvedResource{{services, 0}}},
+		{name: "singular with group", args: []string{"endpointslice.discovery.k8s.io"}, want: []ResolvedResource{{endpointslices, 0}}},
+		{name: "preferred version", args: []string{"ingresses.networking.k8s.io"}, want: []ResolvedResource{{ingresses, 0}}},
+		{name: "explicit version", args: []string{"ingresses.networking.k8s.io/v1beta1"}, want: []ResolvedResource{{ingressesBeta, 0}}},
+		{name: "wildcard resource", args: []string{"*.discovery.k8s.io"}, want: []ResolvedResource{{endpointslices, 0}}},
+		{name: "wildcard core skips subresources and non-watchable", args: []string{"*"}, want: []ResolvedResource{{pods, 0}, {services, 0}}},
+		{name: "wildcard prefix", args: []string{"ingress*.networking.k8s.io"}, want: []ResolvedResource{{ingresses, 0}, {ingressclasses, 0}}},
+		{
+			name: "group",
+			args: []string{"networking.k8s.io/*"},
+			want: []ResolvedResource{{ingresses, 0}, {ingressclasses, 0}, {networkpolices, 0}},
+		},
+		{
+			name: "exclusion",
+			args: []string{"networking.k8s.io/*", "-ingressclasses.networking.k8s.io"},
+			want: []ResolvedResource{{ingresses, 0}, {networkpolices, 0}},
+		},
+		{
+			name: "exclusion before inclusion",
+			args: []string{"-netpol", "networking.k8s.io/*"},
+			want: []ResolvedResource{{ingresses, 1}, {ingressclasses, 1}},
+		},
+		{
+			name: "first match wins",
+			args: []string{"ing", "networking.k8s.io/*", "svc", "services"},
+			want: []ResolvedResource{{ingresses, 0}, {ingressclasses, 1}, {networkpolices, 1}, {services, 2}},
+		},
+		{name: "unknown resource", args: []string{"widgets"}, wantErr: true},
+		{name: "unknown excluded resource", args: []string{"svc", "-widgets"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ResolveResources(newFakeDiscovery(), tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ResolveResources(%v) error = %v, wantErr %v", tt.args, err, tt.wantErr)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) && !tt.wantErr {
+				t.Errorf("ResolveResources(%v) = %v, want %v", tt.args, got, tt.want)
+			}
+		})
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"sync/atomic"
 )
 
 const (
@@ -16,10 +18,11 @@ const (
 
 var (
 	logger *log.Logger
-	Level  = LEVEL_DEBUG
+	level  atomic.Int32 // 运行中可以通过管理接口及配置热加载修改
 )
 
 func init() {
+	level.Store(LEVEL_DEBUG)
 	logger = log.New(os.Stdout, "", 0)
 	logger.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
 }
@@ -29,7 +32,26 @@ func SetLogger(l *log.Logger) {
 }
 
 func SetLevel(l int) {
-	Level = l
+	level.Store(int32(l))
+}
+
+func GetLevel() int {
+	return int(level.Load())
+}
+
+// 读写日志级别的命令行参数，实现pflag.Value
+type LevelValue struct{}
+
+func (LevelValue) String() string { return strconv.Itoa(GetLevel()) }
+func (LevelValue) Type() string   { return "int" }
+
+func (LevelValue) Set(s string) error {
+	l, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	SetLevel(l)
+	return nil
 }
 
 func logPrint(prefix string, v ...any) {
@@ -40,25 +62,25 @@ func logPrint(prefix string, v ...any) {
 }
 
 func Debug(f string, v ...interface{}) {
-	if Level >= LEVEL_DEBUG {
+	if GetLevel() >= LEVEL_DEBUG {
 		logPrint("[DEBUG]", fmt.Sprintf(f, v...))
 	}
 }
 
 func Info(f string, v ...interface{}) {
-	if Level >= LEVEL_INFO {
+	if GetLevel() >= LEVEL_INFO {
 		logPrint("[INFO]", fmt.Sprintf(f, v...))
 	}
 }
 
 func Warn(f string, v ...interface{}) {
-	if Level >= LEVEL_WARN {
+	if GetLevel() >= LEVEL_WARN {
 		logPrint("[WARN]", fmt.Sprintf(f, v...))
 	}
 }
 
 func Error(f string, v ...interface{}) {
-	if Level >= LEVEL_ERROR {
+	if GetLevel() >= LEVEL_ERROR {
 		logPrint("[ERROR]", fmt.Sprintf(f, v...))
 	}
 }
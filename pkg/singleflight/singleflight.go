@@ -0,0 +1,41 @@
+package singleflight
+
+import "sync"
+
+type call struct {
+	wg  sync.WaitGroup
+	val any
+	err error
+}
+
+// 合并相同key的并发调用，同一时刻只有一个调用真正执行，其余调用等待并共享其结果
+type Group struct {
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+// 执行fn并返回结果，shared表示结果是否被多个调用者共享
+func (g *Group) Do(key string, fn func() (any, error)) (val any, err error, shared bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*call)
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.val, c.err, true
+	}
+	c := &call{}
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	defer func() { // fn异常时也要唤醒等待者
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		c.wg.Done()
+	}()
+	c.val, c.err = fn()
+	return c.val, c.err, false
+}